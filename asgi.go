@@ -1,7 +1,7 @@
 package main
 
 import (
-	"fmt"
+	"errors"
 	"log"
 	"math/rand"
 	"time"
@@ -11,6 +11,17 @@ import (
 
 var globalChannelname string
 
+const (
+	// Number of messages that are buffered in the channel of each receiver of
+	// the global channel. More messages are queued by queueMessages.
+	receiverBuffer = 16
+
+	// Number of messages that queueMessages holds for a receiver, that does
+	// not read them. It is the default capacity of the channel layers. More
+	// messages are dropped.
+	receiverQueue = 100
+)
+
 func init() {
 	rand.Seed(time.Now().UTC().UnixNano())
 	globalChannelname = "geiss.response." + asgi.GetChannelnameRandom() + "!"
@@ -31,7 +42,9 @@ var globalReceiveChan chan globalReceiveData
 // messages to receivers.
 func globalReceive() {
 	globalMessage := make(chan globalReceiveData)
-	receivers := make(map[string]globalReceiveData)
+
+	// Each receiver has a queue, so a slow receiver does not block the others.
+	receivers := make(map[string]chan asgi.Message)
 
 	// Read from the global channel.
 	// Currently, this happens in one coroutine. It could be faster if there are
@@ -56,37 +69,59 @@ func globalReceive() {
 			// Someone wants to listen to a channel
 			if data.receiver != nil {
 				// Got a new receiver for a channelname
-				receivers[data.channelname] = data
-			} else {
-				// Else, delete an existing channelname. delete does nothing, if the
-				// channelname does not exist.
+				queue := make(chan asgi.Message)
+				go queueMessages(data.channelname, queue, data.receiver)
+				receivers[data.channelname] = queue
+			} else if queue, ok := receivers[data.channelname]; ok {
+				// Else, delete an existing channelname. The queued messages are
+				// dropped.
+				close(queue)
 				delete(receivers, data.channelname)
 			}
 
 		case message := <-globalMessage:
 			// Got a global message
-			receiver, ok := receivers[message.channelname]
+			queue, ok := receivers[message.channelname]
 			if !ok {
 				// Noone is listening for this channel.
 				log.Printf("Error: Got message on global channel without a receiver, %s", message.message)
 				continue
 			}
-			// Send the message to the receiver.
-			// Do not block. Only try to send the message for one second.
-			go func(receiver globalReceiveData, m asgi.Message) {
-				timeout := time.After(time.Second)
-				select {
-				case receiver.receiver <- m:
-				case <-timeout:
-					log.Printf(
-						"Tried to send a message from %s to a receiver but it was not read. This should never happen. The message was %s",
-						receiver.channelname,
-						m,
-					)
-					// TODO: Should we delete the receiver with the following line?
-					// globalReceiveChan <- globalReceiveData{channelname: receiver.channelname}
-				}
-			}(receiver, message.message)
+			// queueMessages is always ready to receive, so this does not block.
+			queue <- message.message
+		}
+	}
+}
+
+// queueMessages sends the messages from in to out in the same order. It never
+// blocks the sender on in, even if nobody reads from out. If receiverQueue
+// messages are waiting, then new messages are dropped. It returns when in is
+// closed.
+func queueMessages(channelname string, in <-chan asgi.Message, out chan<- asgi.Message) {
+	var queue []asgi.Message
+	for {
+		// If the queue is empty, then send is nil and the select does not try
+		// to send.
+		var send chan<- asgi.Message
+		var next asgi.Message
+		if len(queue) > 0 {
+			send = out
+			next = queue[0]
+		}
+
+		select {
+		case m, ok := <-in:
+			if !ok {
+				return
+			}
+			if len(queue) >= receiverQueue {
+				log.Printf("Error: The receiver of %s does not read its messages. Dropped the message %s", channelname, m)
+				continue
+			}
+			queue = append(queue, m)
+		case send <- next:
+			queue[0] = nil
+			queue = queue[1:]
 		}
 	}
 }
@@ -95,7 +130,7 @@ func globalReceive() {
 // The first one will send the messages received on the registered asgi channel
 // The second should be closed by the caller to unregister the channel.
 func readFromChannel(channelname string) (messages chan asgi.Message, done chan bool) {
-	messages = make(chan asgi.Message)
+	messages = make(chan asgi.Message, receiverBuffer)
 	done = make(chan bool)
 	go func() {
 		// Wait until the done channel was closed
@@ -108,14 +143,24 @@ func readFromChannel(channelname string) (messages chan asgi.Message, done chan
 	return
 }
 
+// errClientGone is returned, when the client closed the connection while
+// waiting for a message.
+var errClientGone = errors.New("the client closed the connection")
+
+// errTimeout is returned, when no message was received in time.
+var errTimeout = errors.New("could not receive a message in time")
+
 // readTimeout reads from the given channel for Duration. Returns the received
-// message. If timeout happens first, then returns an error
-func readTimeout(c chan asgi.Message, t time.Duration) (m asgi.Message, err error) {
+// message. If timeout happens first, then returns errTimeout. If closed is
+// closed first, then it returns errClientGone. closed can be nil.
+func readTimeout(c chan asgi.Message, t time.Duration, closed <-chan struct{}) (m asgi.Message, err error) {
 	timeout := time.After(t)
 	select {
 	case m = <-c:
 	case <-timeout:
-		err = fmt.Errorf("could not receive a message in time")
+		err = errTimeout
+	case <-closed:
+		err = errClientGone
 	}
 	return
 }
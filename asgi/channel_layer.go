@@ -30,6 +30,63 @@ type ChannelLayer interface {
 	NewChannel(string) (string, error)
 }
 
+// GroupLayer is a ChannelLayer that implements the groups extension of the asgi
+// specs. It can send a message to many channels at once.
+type GroupLayer interface {
+	ChannelLayer
+
+	// GroupAdd adds a channel to a group. If the group does not exist, it is
+	// created. Adding a channel, that is already in the group, refreshes its
+	// expiry.
+	GroupAdd(group, channel string) (err error)
+
+	// GroupDiscard removes a channel from a group. It does nothing, if the
+	// channel is not in the group.
+	GroupDiscard(group, channel string) (err error)
+
+	// SendGroup sends a message to all channels in a group. Full channels are
+	// skipped.
+	SendGroup(group string, message Message) (err error)
+}
+
+// FlushLayer is a ChannelLayer that implements the flush extension of the asgi
+// specs.
+type FlushLayer interface {
+	ChannelLayer
+
+	// Flush removes all messages, channels and groups from the channel layer.
+	Flush() (err error)
+}
+
+// Statistics holds the values of the statistics extension of the asgi specs.
+type Statistics struct {
+	// MessagesCount is the number of messages that were send.
+	MessagesCount int64
+
+	// MessagesPending is the number of messages that were send but not received.
+	MessagesPending int64
+
+	// ChannelFullCount is the number of messages that could not be send because
+	// the channel was full.
+	ChannelFullCount int64
+
+	// MessagesPerSecond is the average number of messages that were send per
+	// second in the last few seconds.
+	MessagesPerSecond float64
+}
+
+// StatisticsLayer is a ChannelLayer that implements the statistics extension of
+// the asgi specs.
+type StatisticsLayer interface {
+	ChannelLayer
+
+	// GlobalStatistics returns the statistics of all channels together.
+	GlobalStatistics() (Statistics, error)
+
+	// ChannelStatistics returns the statistics of one channel.
+	ChannelStatistics(channel string) (Statistics, error)
+}
+
 // ChannelFullError is used, when a channel is full
 type ChannelFullError struct {
 	Channel string
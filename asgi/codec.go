@@ -0,0 +1,148 @@
+package asgi
+
+import (
+	"bytes"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"unicode/utf8"
+
+	msgpack "gopkg.in/vmihailenco/msgpack.v2"
+)
+
+// Codec converts messages to bytes and back, so a channel layer can save them.
+type Codec interface {
+	Encode(Message) ([]byte, error)
+	Decode([]byte) (Message, error)
+}
+
+// GetCodec returns the codec with the given name. It can be "msgpack" or
+// "json".
+func GetCodec(name string) (Codec, error) {
+	switch name {
+	case "msgpack", "":
+		return MsgpackCodec{}, nil
+	case "json":
+		return JSONCodec{}, nil
+	default:
+		return nil, fmt.Errorf("unknown codec \"%s\", use msgpack or json", name)
+	}
+}
+
+// MsgpackCodec encodes messages with msgpack. This is the format that is used by
+// channels_redis, so it has to be used, when the workers are written in python.
+type MsgpackCodec struct{}
+
+// Encode encodes a message with msgpack.
+func (MsgpackCodec) Encode(message Message) ([]byte, error) {
+	b, err := msgpack.Marshal(message)
+	if err != nil {
+		return nil, fmt.Errorf("can not encode message %v, got %s", message, err)
+	}
+	return b, nil
+}
+
+// Decode decodes a message from msgpack.
+func (MsgpackCodec) Decode(b []byte) (Message, error) {
+	var message Message
+	if err := msgpack.Unmarshal(b, &message); err != nil {
+		return nil, fmt.Errorf("can not decode message %s, got %s", b, err)
+	}
+	return message, nil
+}
+
+// jsonBytesKey is the key of a json object that holds binary data.
+const jsonBytesKey = "$bytes"
+
+// JSONCodec encodes messages with json. It can be read with redis-cli and by
+// workers in other languages.
+//
+// Json has no type for binary data. Byte slices that are valid utf-8 are encoded
+// as strings. Other byte slices are encoded as an object {"$bytes": BASE64}.
+// So a []byte can be received as string. The Set methods of the message types
+// accept both.
+type JSONCodec struct{}
+
+// Encode encodes a message with json.
+func (JSONCodec) Encode(message Message) ([]byte, error) {
+	b, err := json.Marshal(toJSON(message))
+	if err != nil {
+		return nil, fmt.Errorf("can not encode message %v, got %s", message, err)
+	}
+	return b, nil
+}
+
+// Decode decodes a message from json. Numbers are decoded as json.Number.
+func (JSONCodec) Decode(b []byte) (Message, error) {
+	var message Message
+	decoder := json.NewDecoder(bytes.NewReader(b))
+	decoder.UseNumber()
+	if err := decoder.Decode(&message); err != nil {
+		return nil, fmt.Errorf("can not decode message %s, got %s", b, err)
+	}
+	for k, v := range message {
+		message[k] = fromJSON(v)
+	}
+	return message, nil
+}
+
+// toJSON converts the byte slices in a value to strings or to objects with
+// base64 content.
+func toJSON(value interface{}) interface{} {
+	switch v := value.(type) {
+	case []byte:
+		if utf8.Valid(v) {
+			return string(v)
+		}
+		return map[string]string{jsonBytesKey: base64.StdEncoding.EncodeToString(v)}
+	case Message:
+		m := make(map[string]interface{}, len(v))
+		for k, e := range v {
+			m[k] = toJSON(e)
+		}
+		return m
+	case map[string]interface{}:
+		m := make(map[string]interface{}, len(v))
+		for k, e := range v {
+			m[k] = toJSON(e)
+		}
+		return m
+	case []interface{}:
+		l := make([]interface{}, len(v))
+		for i, e := range v {
+			l[i] = toJSON(e)
+		}
+		return l
+	case [][2][]byte:
+		// The format of headers, see ConvertHeader.
+		l := make([]interface{}, len(v))
+		for i, e := range v {
+			l[i] = []interface{}{toJSON(e[0]), toJSON(e[1])}
+		}
+		return l
+	case [2]interface{}:
+		// The format of client and server, see strToHost.
+		return []interface{}{toJSON(v[0]), toJSON(v[1])}
+	}
+	return value
+}
+
+// fromJSON converts objects with base64 content back to byte slices.
+func fromJSON(value interface{}) interface{} {
+	switch v := value.(type) {
+	case map[string]interface{}:
+		if s, ok := v[jsonBytesKey].(string); ok && len(v) == 1 {
+			if b, err := base64.StdEncoding.DecodeString(s); err == nil {
+				return b
+			}
+		}
+		for k, e := range v {
+			v[k] = fromJSON(e)
+		}
+	case []interface{}:
+		for i, e := range v {
+			v[i] = fromJSON(e)
+		}
+	}
+	return value
+}
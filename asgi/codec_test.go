@@ -0,0 +1,76 @@
+package asgi
+
+import (
+	"bytes"
+	"net/http"
+	"strings"
+	"testing"
+)
+
+func TestCodecs(t *testing.T) {
+	binary := []byte{0, 255, 1, 254}
+	headers := make(http.Header)
+	headers.Add("Content-Type", "text/html")
+
+	for _, name := range []string{"msgpack", "json"} {
+		codec, err := GetCodec(name)
+		if err != nil {
+			t.Fatalf("Did not expect an error, got %s", err)
+		}
+
+		b, err := codec.Encode(Message{
+			"status":       200,
+			"headers":      ConvertHeader(headers),
+			"content":      binary,
+			"more_content": false,
+		})
+		if err != nil {
+			t.Fatalf("Did not expect an error with %s, got %s", name, err)
+		}
+		message, err := codec.Decode(b)
+		if err != nil {
+			t.Fatalf("Did not expect an error with %s, got %s", name, err)
+		}
+
+		var response ResponseMessage
+		if err := response.Set(message); err != nil {
+			t.Errorf("Did not expect an error with %s, got %s", name, err)
+		}
+		if response.Status != 200 {
+			t.Errorf("Expected the status 200 with %s, got %d", name, response.Status)
+		}
+		if !bytes.Equal(response.Content, binary) {
+			t.Errorf("Expected the binary content with %s, got %v", name, response.Content)
+		}
+		if response.Headers.Get("Content-Type") != "text/html" {
+			t.Errorf("Expected the header Content-Type with %s, got %v", name, response.Headers)
+		}
+	}
+
+	if _, err := GetCodec("xml"); err == nil {
+		t.Errorf("Expected an error for an unknown codec")
+	}
+}
+
+func TestJSONCodecReadable(t *testing.T) {
+	b, err := JSONCodec{}.Encode(Message{"text": []byte("hello"), "bytes": []byte{0xff}})
+	if err != nil {
+		t.Fatalf("Did not expect an error, got %s", err)
+	}
+	if !strings.Contains(string(b), `"text":"hello"`) || !strings.Contains(string(b), `"bytes":{"$bytes":"/w=="}`) {
+		t.Errorf("Expected utf-8 bytes as string and other bytes as base64, got %s", b)
+	}
+}
+
+func TestToInt(t *testing.T) {
+	for _, value := range []interface{}{int(7), int8(7), uint8(7), int64(7), uint64(7), float64(7)} {
+		if i, ok := toInt(value); !ok || i != 7 {
+			t.Errorf("Expected %T to be converted to 7, got %d", value, i)
+		}
+	}
+	for _, value := range []interface{}{"7", 7.5, nil} {
+		if _, ok := toInt(value); ok {
+			t.Errorf("Expected %v not to be converted to an int", value)
+		}
+	}
+}
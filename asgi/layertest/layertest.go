@@ -0,0 +1,338 @@
+/*
+Package layertest implements tests, that every asgi channel layer has to pass.
+
+A channel layer calls RunConformance from one of its tests:
+
+	func TestConformance(t *testing.T) {
+		layertest.RunConformance(t, func(expiry, capacity int) asgi.ChannelLayer {
+			return NewChannelLayer(expiry, capacity)
+		})
+	}
+*/
+package layertest
+
+import (
+	"bytes"
+	"fmt"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/ostcar/geiss/asgi"
+)
+
+// Factory creates a new channel layer with the given expiry in seconds and
+// capacity. If expiry or capacity is 0, then the default of the channel layer
+// should be used.
+//
+// Channel layers that save their messages outside of the process should use a
+// prefix, that is not used by other tests, because the tests can run in
+// parallel.
+type Factory func(expiry, capacity int) asgi.ChannelLayer
+
+// Time that a blocking receive is allowed to block, when there is no message.
+const maxBlockTime = 10 * time.Second
+
+// RunConformance runs all conformance tests for the channel layers created by
+// factory.
+func RunConformance(t *testing.T, factory Factory) {
+	tests := []struct {
+		name string
+		test func(*testing.T, Factory, string)
+	}{
+		{"SendAndReceive", testSendAndReceive},
+		{"BinaryPayload", testBinaryPayload},
+		{"Capacity", testCapacity},
+		{"Expiry", testExpiry},
+		{"NewChannel", testNewChannel},
+		{"ProcessLocal", testProcessLocal},
+		{"BlockingTimeout", testBlockingTimeout},
+		{"BlockingReceive", testBlockingReceive},
+		{"Fairness", testFairness},
+		{"Concurrency", testConcurrency},
+	}
+
+	for _, tt := range tests {
+		test := tt.test
+		t.Run(tt.name, func(t *testing.T) {
+			// Use unique channel names for each test, so they do not see messages
+			// from other tests.
+			test(t, factory, "conformance."+asgi.GetChannelnameRandom()+".")
+		})
+	}
+}
+
+// flush removes all messages from the channel layer, if it supports it.
+func flush(c asgi.ChannelLayer) {
+	if f, ok := c.(asgi.FlushLayer); ok {
+		f.Flush()
+	}
+}
+
+// receive receives a message and fails the test, if there is an error.
+func receive(t *testing.T, c asgi.ChannelLayer, channels []string, block bool) (string, asgi.Message) {
+	channel, message, err := c.Receive(channels, block)
+	if err != nil {
+		t.Fatalf("Did not expect an error on receive, got %s", err)
+	}
+	return channel, message
+}
+
+// send sends a message and fails the test, if there is an error.
+func send(t *testing.T, c asgi.ChannelLayer, channel string, message asgi.Message) {
+	if err := c.Send(channel, message); err != nil {
+		t.Fatalf("Did not expect an error on send to %s, got %s", channel, err)
+	}
+}
+
+func testSendAndReceive(t *testing.T, factory Factory, prefix string) {
+	c := factory(0, 0)
+	defer flush(c)
+
+	for _, block := range []bool{true, false} {
+		send(t, c, prefix+"channel", asgi.Message{"text": "my message", "more_content": true})
+
+		channel, message := receive(t, c, []string{prefix + "channel"}, block)
+		if channel != prefix+"channel" {
+			t.Errorf("Expected a message on %schannel, got one on \"%s\"", prefix, channel)
+		}
+		if message["text"] != "my message" || message["more_content"] != true {
+			t.Errorf("Received a wrong message: %v", message)
+		}
+
+		channel, _ = receive(t, c, []string{prefix + "channel"}, false)
+		if channel != "" {
+			t.Errorf("Expected the message to be received only once, got a second one")
+		}
+	}
+}
+
+func testBinaryPayload(t *testing.T, factory Factory, prefix string) {
+	c := factory(0, 0)
+	defer flush(c)
+
+	payload := make([]byte, 256*4)
+	for i := range payload {
+		payload[i] = byte(i)
+	}
+	send(t, c, prefix+"channel", asgi.Message{"bytes": payload, "text": "\x00ü\U0001F410"})
+
+	_, message := receive(t, c, []string{prefix + "channel"}, false)
+	received, ok := message["bytes"].([]byte)
+	if !ok || !bytes.Equal(received, payload) {
+		t.Errorf("Expected the binary payload to be unchanged, got %v", message["bytes"])
+	}
+	if message["text"] != "\x00ü\U0001F410" {
+		t.Errorf("Expected the text to be unchanged, got %v", message["text"])
+	}
+}
+
+func testCapacity(t *testing.T, factory Factory, prefix string) {
+	c := factory(0, 2)
+	defer flush(c)
+
+	send(t, c, prefix+"channel", asgi.Message{})
+	send(t, c, prefix+"channel", asgi.Message{})
+	err := c.Send(prefix+"channel", asgi.Message{})
+	if !asgi.IsChannelFullError(err) {
+		t.Errorf("Expected a channel full error, got %v", err)
+	}
+
+	// Other channels are not affected.
+	send(t, c, prefix+"other", asgi.Message{})
+
+	// After a receive, there is space for one message.
+	receive(t, c, []string{prefix + "channel"}, false)
+	send(t, c, prefix+"channel", asgi.Message{})
+}
+
+func testExpiry(t *testing.T, factory Factory, prefix string) {
+	c := factory(1, 0)
+	defer flush(c)
+
+	send(t, c, prefix+"channel", asgi.Message{"text": "expired"})
+	time.Sleep(2100 * time.Millisecond)
+	send(t, c, prefix+"channel", asgi.Message{"text": "not expired"})
+
+	_, message := receive(t, c, []string{prefix + "channel"}, false)
+	if message["text"] != "not expired" {
+		t.Errorf("Expected the first message to be expired, got %v", message)
+	}
+}
+
+func testNewChannel(t *testing.T, factory Factory, prefix string) {
+	c := factory(0, 0)
+	defer flush(c)
+
+	for _, channelPrefix := range []string{prefix + "local!", prefix + "single?"} {
+		seen := make(map[string]bool)
+		for i := 0; i < 100; i++ {
+			channel, err := c.NewChannel(channelPrefix)
+			if err != nil {
+				t.Fatalf("Did not expect an error, got %s", err)
+			}
+			if !strings.HasPrefix(channel, channelPrefix) || len(channel) == len(channelPrefix) {
+				t.Errorf("Expected the channel name to start with %s and have a suffix, got %s", channelPrefix, channel)
+			}
+			if seen[channel] {
+				t.Errorf("Got the channel name %s two times", channel)
+			}
+			seen[channel] = true
+		}
+	}
+}
+
+func testProcessLocal(t *testing.T, factory Factory, prefix string) {
+	c := factory(0, 0)
+	defer flush(c)
+
+	channels := make([]string, 3)
+	for i := range channels {
+		channel, err := c.NewChannel(prefix + "process!")
+		if err != nil {
+			t.Fatalf("Did not expect an error, got %s", err)
+		}
+		channels[i] = channel
+		send(t, c, channel, asgi.Message{"text": channel})
+	}
+
+	// All messages are received on the non local channel name, in the order
+	// they were send.
+	for _, expected := range channels {
+		channel, message := receive(t, c, []string{prefix + "process!"}, false)
+		if channel != expected {
+			t.Errorf("Expected a message on %s, got one on \"%s\"", expected, channel)
+		}
+		if message["text"] != expected {
+			t.Errorf("Received the wrong message %v", message)
+		}
+		if _, ok := message["__asgi_channel__"]; ok {
+			t.Errorf("Expected the internal field __asgi_channel__ to be removed, got %v", message)
+		}
+	}
+}
+
+func testBlockingTimeout(t *testing.T, factory Factory, prefix string) {
+	c := factory(0, 0)
+	defer flush(c)
+
+	start := time.Now()
+	channel, message := receive(t, c, []string{prefix + "empty"}, true)
+	if channel != "" || message != nil {
+		t.Errorf("Expected no message from an empty channel, got %v on \"%s\"", message, channel)
+	}
+	if d := time.Since(start); d > maxBlockTime {
+		t.Errorf("Expected a blocking receive to return after some time, it blocked %s", d)
+	}
+
+	start = time.Now()
+	receive(t, c, []string{prefix + "empty"}, false)
+	if d := time.Since(start); d > time.Second {
+		t.Errorf("Expected a non blocking receive to return at once, it blocked %s", d)
+	}
+}
+
+func testBlockingReceive(t *testing.T, factory Factory, prefix string) {
+	c := factory(0, 0)
+	defer flush(c)
+
+	go func() {
+		time.Sleep(200 * time.Millisecond)
+		if err := c.Send(prefix+"channel", asgi.Message{}); err != nil {
+			t.Errorf("Did not expect an error, got %s", err)
+		}
+	}()
+
+	channel, _ := receive(t, c, []string{prefix + "other", prefix + "channel"}, true)
+	if channel != prefix+"channel" {
+		t.Errorf("Expected the blocking receive to get the message on %schannel, got \"%s\"", prefix, channel)
+	}
+}
+
+func testFairness(t *testing.T, factory Factory, prefix string) {
+	c := factory(0, 0)
+	defer flush(c)
+
+	const count = 20
+	channels := []string{prefix + "first", prefix + "second"}
+	for i := 0; i < count; i++ {
+		for _, channel := range channels {
+			send(t, c, channel, asgi.Message{})
+		}
+	}
+
+	received := make(map[string]int)
+	for i := 0; i < count; i++ {
+		channel, _ := receive(t, c, channels, false)
+		received[channel]++
+	}
+	for _, channel := range channels {
+		if received[channel] == 0 {
+			t.Errorf("Expected to receive messages from all channels, got none from %s", channel)
+		}
+	}
+}
+
+func testConcurrency(t *testing.T, factory Factory, prefix string) {
+	c := factory(0, 1000)
+	defer flush(c)
+
+	const senders, messages = 10, 20
+	var wg sync.WaitGroup
+	for i := 0; i < senders; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			for j := 0; j < messages; j++ {
+				if err := c.Send(prefix+"channel", asgi.Message{"text": fmt.Sprintf("%d-%d", i, j)}); err != nil {
+					t.Errorf("Did not expect an error, got %s", err)
+				}
+			}
+		}(i)
+	}
+
+	var mu sync.Mutex
+	received := make(map[string]int)
+	var receivers sync.WaitGroup
+	for i := 0; i < senders; i++ {
+		receivers.Add(1)
+		go func() {
+			defer receivers.Done()
+			deadline := time.Now().Add(maxBlockTime)
+			for time.Now().Before(deadline) {
+				mu.Lock()
+				done := len(received) == senders*messages
+				mu.Unlock()
+				if done {
+					return
+				}
+
+				channel, message, err := c.Receive([]string{prefix + "channel"}, false)
+				if err != nil {
+					t.Errorf("Did not expect an error, got %s", err)
+					return
+				}
+				if channel == "" {
+					time.Sleep(10 * time.Millisecond)
+					continue
+				}
+				mu.Lock()
+				received[fmt.Sprint(message["text"])]++
+				mu.Unlock()
+			}
+		}()
+	}
+
+	wg.Wait()
+	receivers.Wait()
+
+	if len(received) != senders*messages {
+		t.Errorf("Expected to receive %d different messages, got %d", senders*messages, len(received))
+	}
+	for text, n := range received {
+		if n != 1 {
+			t.Errorf("Expected to receive message %s once, got it %d times", text, n)
+		}
+	}
+}
@@ -0,0 +1,199 @@
+/*
+Package memory implements an asgi channel layer that holds all messages in the
+memory of the running process.
+
+It can only be used, when the protocol server and the workers run in the same
+process, for example in tests or in a single node setup with a go worker.
+*/
+package memory
+
+import (
+	"math/rand"
+	"sync"
+	"time"
+
+	"github.com/ostcar/geiss/asgi"
+)
+
+// Sets the time that Receive() with block=true should wait for a message.
+const receiveTimeout = 3 * time.Second
+
+// envelope is a encoded message in a channel.
+type envelope struct {
+	content []byte
+	expires time.Time
+}
+
+// ChannelLayer is the main type to use as memory channel layer.
+type ChannelLayer struct {
+	expiry   time.Duration
+	capacity int
+	codec    asgi.Codec
+
+	mu       sync.Mutex
+	channels map[string][]envelope
+
+	// notify is closed and replaced each time a message is send. Blocking
+	// receivers wait for it.
+	notify chan struct{}
+}
+
+// NewChannelLayer creates a new memory ChannelLayer
+func NewChannelLayer(expiry int, capacity int) *ChannelLayer {
+	if expiry == 0 {
+		expiry = 60
+	}
+	if capacity == 0 {
+		capacity = 100
+	}
+	return &ChannelLayer{
+		expiry:   time.Duration(expiry) * time.Second,
+		capacity: capacity,
+		codec:    asgi.MsgpackCodec{},
+		channels: make(map[string][]envelope),
+		notify:   make(chan struct{}),
+	}
+}
+
+// SetCodec sets the codec to encode the messages. The default is msgpack.
+func (m *ChannelLayer) SetCodec(codec asgi.Codec) {
+	m.codec = codec
+}
+
+// queue returns the messages of a channel that are not expired. It also removes
+// the expired messages from the channel. The caller has to hold the lock.
+func (m *ChannelLayer) queue(channel string) []envelope {
+	queue := m.channels[channel]
+	now := time.Now()
+
+	// All messages have the same expiry, so the oldest messages are the first
+	// one that expire.
+	i := 0
+	for i < len(queue) && !queue[i].expires.After(now) {
+		i++
+	}
+	queue = queue[i:]
+	if len(queue) == 0 {
+		delete(m.channels, channel)
+		return nil
+	}
+	m.channels[channel] = queue
+	return queue
+}
+
+// NewChannel creates a new channelname
+func (m *ChannelLayer) NewChannel(channelPrefix string) (channel string, err error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	for {
+		// Create a channel name
+		channel = channelPrefix + asgi.GetChannelnameRandom()
+
+		// If the channel does not exist, then return the (free) channelname
+		if m.queue(channel) == nil {
+			return channel, nil
+		}
+	}
+}
+
+// Send sends a message to a specific channel
+func (m *ChannelLayer) Send(channel string, message asgi.Message) (err error) {
+	// Messages to process specific channels are send to the non local channel.
+	name, message := asgi.ProcessLocal(channel, message)
+
+	// Encodes the message with the codec. This makes a copy of the message and
+	// makes sure, that the receiver gets the same types as with the redis
+	// channel layer.
+	bytes, err := m.codec.Encode(message)
+	if err != nil {
+		return err
+	}
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	queue := m.queue(name)
+	if len(queue) >= m.capacity {
+		return asgi.ChannelFullError{
+			Channel: channel,
+		}
+	}
+	m.channels[name] = append(queue, envelope{
+		content: bytes,
+		expires: time.Now().Add(m.expiry),
+	})
+
+	// Wake up all blocking receivers
+	close(m.notify)
+	m.notify = make(chan struct{})
+	return nil
+}
+
+// popMany returns the first message from a random channel that has one. It
+// returns an empty channel name, if there is no message. The second return
+// value is a channel that is closed, when the next message is send.
+func (m *ChannelLayer) popMany(channels []string) (channel string, content []byte, notify chan struct{}) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	// Use a random order, so the first channels do not starve the others.
+	for _, i := range rand.Perm(len(channels)) {
+		channel = channels[i]
+		queue := m.queue(channel)
+		if len(queue) == 0 {
+			continue
+		}
+		content = queue[0].content
+		if len(queue) == 1 {
+			delete(m.channels, channel)
+		} else {
+			m.channels[channel] = queue[1:]
+		}
+		return channel, content, nil
+	}
+	return "", nil, m.notify
+}
+
+// Receive reads from a channel and returns a raw message objekt
+func (m *ChannelLayer) Receive(
+	channels []string,
+	block bool) (channel string, message asgi.Message, err error) {
+
+	var content []byte
+	var notify chan struct{}
+	timeout := time.After(receiveTimeout)
+
+	for {
+		channel, content, notify = m.popMany(channels)
+		if channel != "" || !block {
+			break
+		}
+
+		// If block is True, then this method should wait until there is a message
+		// to receive or the timeout happens.
+		select {
+		case <-notify:
+		case <-timeout:
+			// Got timeout. Nothing to receive
+			return "", nil, nil
+		}
+	}
+
+	if channel == "" {
+		// Nothing to receive
+		return "", nil, nil
+	}
+
+	// content is an encoded message. First decode it.
+	if message, err = m.codec.Decode(content); err != nil {
+		return "", nil, err
+	}
+
+	// check if there is a channel information in the raw message
+	if v, ok := message["__asgi_channel__"]; ok {
+		channel = v.(string)
+		delete(message, "__asgi_channel__")
+	}
+	return
+}
@@ -0,0 +1,165 @@
+package memory
+
+import (
+	"fmt"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/ostcar/geiss/asgi"
+	"github.com/ostcar/geiss/asgi/layertest"
+)
+
+func TestNewChannel(t *testing.T) {
+	c := NewChannelLayer(0, 0)
+
+	channel, err := c.NewChannel("myprefix!")
+	if err != nil {
+		t.Errorf("Did not expect an error, got %s", err)
+	}
+	if !strings.HasPrefix(channel, "myprefix!") {
+		t.Errorf("Expect the channelname to start with \"myprefix!\", got %s", channel)
+	}
+}
+
+type testMessage struct {
+	s string
+}
+
+func (t *testMessage) Raw() asgi.Message {
+	m := make(asgi.Message)
+	m["message"] = t.s
+	return m
+}
+
+func (t *testMessage) Set(m asgi.Message) error {
+	var ok bool
+	t.s, ok = m["message"].(string)
+	if !ok {
+		return fmt.Errorf("Message has wrong format %T", m["message"])
+	}
+	return nil
+}
+
+func TestSendAndReceive(t *testing.T) {
+	innerTest := func(block bool) {
+		c := NewChannelLayer(0, 0)
+		sendMessage := testMessage{
+			s: "MyMessage",
+		}
+		err := c.Send("MyChannel", sendMessage.Raw())
+		if err != nil {
+			t.Errorf("Did not expect any error, got %s", err)
+		}
+
+		channel, message, err := c.Receive([]string{"MyChannel"}, block)
+		if err != nil {
+			t.Errorf("Did not expect any error, got %s", err)
+		}
+
+		var receiveMessage testMessage
+		err = receiveMessage.Set(message)
+		if err != nil {
+			t.Errorf("Did not expect any error, got %s", err)
+		}
+
+		if channel != "MyChannel" {
+			t.Errorf("Did expect the channel name MyChannel, got \"%s\"", channel)
+		}
+		if receiveMessage != sendMessage {
+			t.Errorf("Expect the send message to be the received message")
+		}
+	}
+	innerTest(true)
+	innerTest(false)
+}
+
+func TestReceiveBlocking(t *testing.T) {
+	c := NewChannelLayer(0, 0)
+	sendMessage := testMessage{
+		s: "MyMessage",
+	}
+
+	go func() {
+		time.Sleep(100 * time.Millisecond)
+		if err := c.Send("MyChannel", sendMessage.Raw()); err != nil {
+			t.Errorf("Did not expect any error, got %s", err)
+		}
+	}()
+
+	channel, _, err := c.Receive([]string{"OtherChannel", "MyChannel"}, true)
+	if err != nil {
+		t.Errorf("Did not expect any error, got %s", err)
+	}
+	if channel != "MyChannel" {
+		t.Errorf("Did expect the channel name MyChannel, got \"%s\"", channel)
+	}
+
+	channel, _, err = c.Receive([]string{"MyChannel"}, false)
+	if err != nil {
+		t.Errorf("Did not expect any error, got %s", err)
+	}
+	if channel != "" {
+		t.Errorf("Did expect no message, got one on \"%s\"", channel)
+	}
+}
+
+func TestSendChannelFull(t *testing.T) {
+	c := NewChannelLayer(0, 1)
+	sendMessage := testMessage{
+		s: "MyMessage",
+	}
+	channelname, err := c.NewChannel("TestSendChannelFull")
+	if err != nil {
+		t.Errorf("Did not expect an error, got %s", err)
+	}
+	err = c.Send(channelname, sendMessage.Raw())
+	if err != nil {
+		t.Errorf("Did not expect an error, got %s", err)
+	}
+	err = c.Send(channelname, sendMessage.Raw())
+	if !asgi.IsChannelFullError(err) {
+		t.Errorf("Expected a channel full error, got %s", err)
+	}
+}
+
+func TestMessageExpiry(t *testing.T) {
+	c := NewChannelLayer(1, 1)
+	sendMessage := testMessage{
+		s: "MyMessage",
+	}
+	if err := c.Send("MyChannel", sendMessage.Raw()); err != nil {
+		t.Errorf("Did not expect an error, got %s", err)
+	}
+
+	time.Sleep(1100 * time.Millisecond)
+
+	// The first message is expired, so the channel is not full anymore.
+	if err := c.Send("MyChannel", sendMessage.Raw()); err != nil {
+		t.Errorf("Did not expect an error, got %s", err)
+	}
+	if _, _, err := c.Receive([]string{"MyChannel"}, false); err != nil {
+		t.Errorf("Did not expect an error, got %s", err)
+	}
+	channel, _, err := c.Receive([]string{"MyChannel"}, false)
+	if err != nil {
+		t.Errorf("Did not expect an error, got %s", err)
+	}
+	if channel != "" {
+		t.Errorf("Expected the first message to be expired, got a message on \"%s\"", channel)
+	}
+}
+
+func TestConformance(t *testing.T) {
+	layertest.RunConformance(t, func(expiry, capacity int) asgi.ChannelLayer {
+		return NewChannelLayer(expiry, capacity)
+	})
+}
+
+func TestConformanceJSON(t *testing.T) {
+	layertest.RunConformance(t, func(expiry, capacity int) asgi.ChannelLayer {
+		c := NewChannelLayer(expiry, capacity)
+		c.SetCodec(asgi.JSONCodec{})
+		return c
+	})
+}
@@ -70,17 +70,58 @@ func (r *RequestMessage) Raw() Message {
 	m["headers"] = ConvertHeader(r.Headers)
 	m["body"] = r.Body
 	m["body_channel"] = r.BodyChannel
-	m["client"], err = strToHost(r.Client)
+	m["client"], err = optionalHost(r.Client)
 	if err != nil {
 		log.Panicf("Could not create the client value for a request message: %s", err)
 	}
-	m["server"], err = strToHost(r.Server)
+	m["server"], err = optionalHost(r.Server)
 	if err != nil {
 		log.Panicf("Could not create the server value for a request message: %s", err)
 	}
 	return m
 }
 
+// Set fills the values of a RequestMessage with the data of a message dict.
+func (r *RequestMessage) Set(m Message) (err error) {
+	if r.ReplyChannel, err = getString(m, "reply_channel"); err != nil {
+		return err
+	}
+	if r.HTTPVersion, err = getString(m, "http_version"); err != nil {
+		return err
+	}
+	if r.Method, err = getString(m, "method"); err != nil {
+		return err
+	}
+	if r.Scheme, err = getString(m, "scheme"); err != nil {
+		return err
+	}
+	if r.Path, err = getString(m, "path"); err != nil {
+		return err
+	}
+	if r.QueryString, err = getBytes(m, "query_string"); err != nil {
+		return err
+	}
+	if r.RootPath, err = getString(m, "root_path"); err != nil {
+		return err
+	}
+	if r.Headers, err = parseHeader(m["headers"]); err != nil {
+		return err
+	}
+	if r.Body, err = getBytes(m, "body"); err != nil {
+		return err
+	}
+	if r.BodyChannel, err = getString(m, "body_channel"); err != nil {
+		return err
+	}
+	if r.Client, err = hostToStr(m["client"]); err != nil {
+		return fmt.Errorf("message has wrong format. \"client\": %s", err)
+	}
+	if r.Server, err = hostToStr(m["server"]); err != nil {
+		return fmt.Errorf("message has wrong format. \"server\": %s", err)
+	}
+	return nil
+}
+
 // RequestBodyChunkMessage is a structured message type, defined by the asgi
 // specs which is used to continue forwarding an http request from a client to
 // the channel layer, if the request body was big.
@@ -100,6 +141,19 @@ func (r *RequestBodyChunkMessage) Raw() Message {
 	return m
 }
 
+// Set fills the values of a RequestBodyChunkMessage with the data of a message
+// dict.
+func (r *RequestBodyChunkMessage) Set(m Message) (err error) {
+	if r.Content, err = getBytes(m, "content"); err != nil {
+		return err
+	}
+	if r.Closed, err = getBool(m, "closed"); err != nil {
+		return err
+	}
+	r.MoreContent, err = getBool(m, "more_content")
+	return err
+}
+
 // ResponseChunkMessage is a structured message type, defined by the asgi specs.
 // It is used to forward an response from the channel layer to the client.
 // It has to follow a ResponseMessage.
@@ -109,16 +163,21 @@ type ResponseChunkMessage struct {
 	MoreContent bool
 }
 
+// Raw converts a ResponseChunkMessage to a Message dict.
+func (rm *ResponseChunkMessage) Raw() Message {
+	m := make(Message)
+	m["content"] = rm.Content
+	m["more_content"] = rm.MoreContent
+	return m
+}
+
 // Set fills the values of a ResponseChunkMessage with a the data of a message dict.
 func (rm *ResponseChunkMessage) Set(m Message) (err error) {
 	var ok bool
 
-	switch t := m["content"].(type) {
-	case []byte:
-		rm.Content = t
-	case nil:
+	if m["content"] == nil {
 		rm.Content = []byte{}
-	default:
+	} else if rm.Content, ok = toBytes(m["content"]); !ok {
 		return fmt.Errorf(
 			"message has wrong format. \"content\" has to be []byte or nil, not %T",
 			m["content"],
@@ -145,25 +204,29 @@ type ResponseMessage struct {
 	Headers http.Header
 }
 
+// Raw converts a ResponseMessage to a Message dict.
+func (rm *ResponseMessage) Raw() Message {
+	m := rm.ResponseChunkMessage.Raw()
+	m["status"] = rm.Status
+	m["headers"] = ConvertHeader(rm.Headers)
+	return m
+}
+
 // Set fills the values of a ResponseMessage with a the data of a message dict.
 func (rm *ResponseMessage) Set(m Message) (err error) {
 	var ok bool
 
-	status, ok := m["status"].(uint64)
+	rm.Status, ok = toInt(m["status"])
 	if !ok {
 		return fmt.Errorf(
-			"message has wrong format. \"status\" has to be uint64 not %T",
+			"message has wrong format. \"status\" has to be an integer not %T",
 			m["status"],
 		)
 	}
-	rm.Status = int(status)
 
-	switch t := m["content"].(type) {
-	case []byte:
-		rm.Content = t
-	case nil:
+	if m["content"] == nil {
 		rm.Content = []byte{}
-	default:
+	} else if rm.Content, ok = toBytes(m["content"]); !ok {
 		return fmt.Errorf(
 			"message has wrong format. \"content\" has to be []byte or nil, not %T",
 			m["content"],
@@ -178,22 +241,73 @@ func (rm *ResponseMessage) Set(m Message) (err error) {
 		)
 	}
 
-	rm.Headers = make(http.Header)
-	headers, ok := m["headers"].([]interface{})
+	rm.Headers, err = parseHeader(m["headers"])
+	return err
+}
+
+// ServerPushMessage is a structured message type, defined by the asgi specs. It
+// is send on the reply channel of a response after the ResponseMessage and
+// before the last ResponseChunkMessage to push a resource to the client with
+// HTTP/2. The fields ReplyChannel, Body and BodyChannel of the Request are not
+// used.
+// It differs from the specs that the fields are uppercase and CamelCase.
+type ServerPushMessage struct {
+	Request RequestMessage
+}
+
+// Raw converts a ServerPushMessage to a Message dict.
+func (sp *ServerPushMessage) Raw() Message {
+	request := sp.Request.Raw()
+	delete(request, "reply_channel")
+	delete(request, "body")
+	delete(request, "body_channel")
+
+	m := make(Message)
+	m["request"] = request
+	return m
+}
+
+// Set fills the values of a ServerPushMessage with the data of a message dict.
+func (sp *ServerPushMessage) Set(m Message) error {
+	request, ok := toMessage(m["request"])
 	if !ok {
-		return fmt.Errorf("message has wrong format. \"headers\" has to be a list not %T", m["headers"])
+		return fmt.Errorf("message has wrong format. \"request\" has to be a dict not %T", m["request"])
 	}
-	for _, value := range headers {
-		// value should be a slice of interface{}
-		value := value.([]interface{})
-		k := string(value[0].([]byte))
-		v := string(value[1].([]byte))
-		rm.Headers.Add(k, v)
-	}
-	return nil
+	return sp.Request.Set(request)
+}
+
+// IsServerPush returns true, if the message is a server push message.
+func IsServerPush(m Message) bool {
+	_, ok := m["request"]
+	return ok
+}
+
+// HTTPDisconnectMessage is a structured message type, defined by the asgi
+// specs. It is send to the channel "http.disconnect", when the client closed the
+// connection before the response was sent.
+// It differs from the specs that the fields are uppercase and CamelCase.
+type HTTPDisconnectMessage struct {
+	ReplyChannel string
+	Path         string
 }
 
-// TODO: Impelement "Server Push" and "Disconnect"
+// Raw converts a HTTPDisconnectMessage to a Message dict.
+func (dm *HTTPDisconnectMessage) Raw() Message {
+	m := make(Message)
+	m["reply_channel"] = dm.ReplyChannel
+	m["path"] = dm.Path
+	return m
+}
+
+// Set fills the values of a HTTPDisconnectMessage with the data of a message
+// dict.
+func (dm *HTTPDisconnectMessage) Set(m Message) (err error) {
+	if dm.ReplyChannel, err = getString(m, "reply_channel"); err != nil {
+		return err
+	}
+	dm.Path, err = getString(m, "path")
+	return err
+}
 
 // ConnectionMessage is a structured message defined by the asgi specs. It is used
 // to forware an websocket connection request to the channel layer.
@@ -222,11 +336,11 @@ func (cm *ConnectionMessage) Raw() Message {
 	m["query_string"] = cm.QueryString
 	m["root_path"] = cm.RootPath
 	m["headers"] = ConvertHeader(cm.Headers)
-	m["client"], err = strToHost(cm.Client)
+	m["client"], err = optionalHost(cm.Client)
 	if err != nil {
 		log.Panicf("Could not create the client value for a connection message: %s", err)
 	}
-	m["server"], err = strToHost(cm.Server)
+	m["server"], err = optionalHost(cm.Server)
 	if err != nil {
 		log.Panicf("Could not create the server value for a connection message: %s", err)
 	}
@@ -234,6 +348,35 @@ func (cm *ConnectionMessage) Raw() Message {
 	return m
 }
 
+// Set fills the values of a ConnectionMessage with the data of a message dict.
+func (cm *ConnectionMessage) Set(m Message) (err error) {
+	if cm.ReplyChannel, err = getString(m, "reply_channel"); err != nil {
+		return err
+	}
+	if cm.Scheme, err = getString(m, "scheme"); err != nil {
+		return err
+	}
+	if cm.Path, err = getString(m, "path"); err != nil {
+		return err
+	}
+	if cm.QueryString, err = getBytes(m, "query_string"); err != nil {
+		return err
+	}
+	if cm.RootPath, err = getString(m, "root_path"); err != nil {
+		return err
+	}
+	if cm.Headers, err = parseHeader(m["headers"]); err != nil {
+		return err
+	}
+	if cm.Client, err = hostToStr(m["client"]); err != nil {
+		return fmt.Errorf("message has wrong format. \"client\": %s", err)
+	}
+	if cm.Server, err = hostToStr(m["server"]); err != nil {
+		return fmt.Errorf("message has wrong format. \"server\": %s", err)
+	}
+	return nil
+}
+
 // ReceiveMessage is message specified by the asgi spec
 type ReceiveMessage struct {
 	ReplyChannel string
@@ -259,6 +402,33 @@ func (cm *ReceiveMessage) Raw() Message {
 	return m
 }
 
+// Set fills the values of a ReceiveMessage with the data of a message dict. If
+// the field text is set, then the Type is websocket.TextMessage, else
+// websocket.BinaryMessage.
+func (cm *ReceiveMessage) Set(m Message) (err error) {
+	if cm.ReplyChannel, err = getString(m, "reply_channel"); err != nil {
+		return err
+	}
+	if cm.Path, err = getString(m, "path"); err != nil {
+		return err
+	}
+	if m["text"] != nil {
+		var text string
+		if text, err = getString(m, "text"); err != nil {
+			return err
+		}
+		cm.Content = []byte(text)
+		cm.Type = websocket.TextMessage
+	} else {
+		if cm.Content, err = getBytes(m, "bytes"); err != nil {
+			return err
+		}
+		cm.Type = websocket.BinaryMessage
+	}
+	cm.Order, err = getInt(m, "order")
+	return err
+}
+
 // DisconnectionMessage is a structured message defined by the asgi specs. It is
 // send to the channel layer when the connection was closed for any reason.
 // It differs from the asgi specs that all fields are Uppercase and CamelCase.
@@ -280,10 +450,27 @@ func (dm *DisconnectionMessage) Raw() Message {
 	return m
 }
 
+// Set fills the values of a DisconnectionMessage with the data of a message
+// dict.
+func (dm *DisconnectionMessage) Set(m Message) (err error) {
+	if dm.ReplyChannel, err = getString(m, "reply_channel"); err != nil {
+		return err
+	}
+	if dm.Code, err = getInt(m, "code"); err != nil {
+		return err
+	}
+	if dm.Path, err = getString(m, "path"); err != nil {
+		return err
+	}
+	dm.Order, err = getInt(m, "order")
+	return err
+}
+
 // SendCloseAcceptMessage is a structured message defined by the asgi specs. It
 // is used as answer from the channel layer after a websocket connection and to s
 // end data to an open websocket connection.
 // It differs from the asgi specs that all fields are Uppercase and CamelCase.
+// Close is the close code. 0 means, that the connection should not be closed.
 type SendCloseAcceptMessage struct {
 	Bytes  []byte
 	Text   string
@@ -291,12 +478,34 @@ type SendCloseAcceptMessage struct {
 	Accept bool
 }
 
+// Raw converts a SendCloseAcceptMessage to a Message dict.
+func (s *SendCloseAcceptMessage) Raw() Message {
+	m := make(Message)
+	m["bytes"] = nil
+	if s.Bytes != nil {
+		m["bytes"] = s.Bytes
+	}
+	m["text"] = nil
+	if s.Text != "" {
+		m["text"] = s.Text
+	}
+	m["close"] = false
+	if s.Close != 0 {
+		m["close"] = s.Close
+	}
+	m["accept"] = s.Accept
+	return m
+}
+
 // Set fills the values of a SendCloseAcceptMessage with a the data of a message
 // dict.
 func (s *SendCloseAcceptMessage) Set(m Message) (err error) {
 	switch t := m["bytes"].(type) {
 	case []byte:
 		s.Bytes = t
+	case string:
+		// Some codecs decode bytes as string.
+		s.Bytes = []byte(t)
 	case nil:
 		s.Bytes = nil
 	default:
@@ -318,17 +527,19 @@ func (s *SendCloseAcceptMessage) Set(m Message) (err error) {
 
 	switch t := m["close"].(type) {
 	case bool:
+		// true closes the connection with the normal close code.
 		if t {
-			s.Close = 0
-		} else {
 			s.Close = 1000
+		} else {
+			s.Close = 0
 		}
-	case int:
-		s.Close = t
 	case nil:
 		s.Close = 0
 	default:
-		return fmt.Errorf("the field \"close\" has to be bool, int or nil, not %T", m["close"])
+		var ok bool
+		if s.Close, ok = toInt(t); !ok {
+			return fmt.Errorf("the field \"close\" has to be bool, int or nil, not %T", m["close"])
+		}
 	}
 
 	switch t := m["accept"].(type) {
@@ -0,0 +1,156 @@
+package asgi
+
+import (
+	"net/http"
+	"reflect"
+	"testing"
+
+	"github.com/gorilla/websocket"
+)
+
+func TestMessageRoundTrip(t *testing.T) {
+	headers := make(http.Header)
+	headers.Add("Content-Type", "text/html")
+	headers.Add("Set-Cookie", "a=1")
+	headers.Add("Set-Cookie", "b=2")
+
+	tests := []struct {
+		message Messager
+		empty   func() Messager
+	}{
+		{
+			&RequestMessage{
+				ReplyChannel: "http.response!abc",
+				HTTPVersion:  "1.1",
+				Method:       "POST",
+				Scheme:       "https",
+				Path:         "/päth/",
+				QueryString:  []byte("a=1&b=2"),
+				RootPath:     "/root",
+				Headers:      headers,
+				Body:         []byte("body"),
+				BodyChannel:  "http.request.body?abc",
+				Client:       "127.0.0.1:54321",
+				Server:       "[::1]:8000",
+			},
+			func() Messager { return &RequestMessage{} },
+		},
+		{
+			&RequestBodyChunkMessage{Content: []byte("chunk"), Closed: true, MoreContent: true},
+			func() Messager { return &RequestBodyChunkMessage{} },
+		},
+		{
+			&ResponseMessage{
+				ResponseChunkMessage: ResponseChunkMessage{Content: []byte{0, 1, 255}, MoreContent: true},
+				Status:               404,
+				Headers:              headers,
+			},
+			func() Messager { return &ResponseMessage{} },
+		},
+		{
+			&ResponseChunkMessage{Content: []byte("chunk"), MoreContent: false},
+			func() Messager { return &ResponseChunkMessage{} },
+		},
+		{
+			&HTTPDisconnectMessage{ReplyChannel: "http.response!abc", Path: "/poll/"},
+			func() Messager { return &HTTPDisconnectMessage{} },
+		},
+		{
+			&ConnectionMessage{
+				ReplyChannel: "websocket.send!abc",
+				Scheme:       "wss",
+				Path:         "/ws/",
+				QueryString:  []byte("a=1"),
+				RootPath:     "/root",
+				Headers:      headers,
+				Client:       "10.0.0.1:1234",
+				Server:       "10.0.0.2:443",
+			},
+			func() Messager { return &ConnectionMessage{} },
+		},
+		{
+			&ReceiveMessage{ReplyChannel: "websocket.send!abc", Path: "/ws/", Content: []byte("hello"), Type: websocket.TextMessage, Order: 3},
+			func() Messager { return &ReceiveMessage{} },
+		},
+		{
+			&ReceiveMessage{ReplyChannel: "websocket.send!abc", Path: "/ws/", Content: []byte{0, 255}, Type: websocket.BinaryMessage, Order: 4},
+			func() Messager { return &ReceiveMessage{} },
+		},
+		{
+			&DisconnectionMessage{ReplyChannel: "websocket.send!abc", Code: 1001, Path: "/ws/", Order: 5},
+			func() Messager { return &DisconnectionMessage{} },
+		},
+		{
+			&ServerPushMessage{Request: RequestMessage{
+				HTTPVersion: "2",
+				Method:      "GET",
+				Scheme:      "https",
+				Path:        "/static/style.css",
+				QueryString: []byte("v=1"),
+				Headers:     headers,
+			}},
+			func() Messager { return &ServerPushMessage{} },
+		},
+		{
+			&SendCloseAcceptMessage{Text: "hello", Close: 4000, Accept: true},
+			func() Messager { return &SendCloseAcceptMessage{} },
+		},
+		{
+			&SendCloseAcceptMessage{Bytes: []byte{0, 255}},
+			func() Messager { return &SendCloseAcceptMessage{} },
+		},
+	}
+
+	codecs := map[string]Codec{"none": nil, "msgpack": MsgpackCodec{}, "json": JSONCodec{}}
+	for _, tt := range tests {
+		for name, codec := range codecs {
+			raw := tt.message.Raw()
+			if codec != nil {
+				b, err := codec.Encode(raw)
+				if err != nil {
+					t.Fatalf("Did not expect an error on encode with %s, got %s", name, err)
+				}
+				if raw, err = codec.Decode(b); err != nil {
+					t.Fatalf("Did not expect an error on decode with %s, got %s", name, err)
+				}
+			}
+
+			got := tt.empty()
+			if err := got.Set(raw); err != nil {
+				t.Errorf("Did not expect an error on Set of %T with %s, got %s", got, name, err)
+			}
+			if !reflect.DeepEqual(got, tt.message) {
+				t.Errorf("Expected %+v after a round trip with %s, got %+v", tt.message, name, got)
+			}
+		}
+	}
+}
+
+func TestSendCloseAcceptMessageClose(t *testing.T) {
+	for value, expected := range map[interface{}]int{true: 1000, false: 0, nil: 0, 4000: 4000, uint64(1001): 1001} {
+		var s SendCloseAcceptMessage
+		if err := s.Set(Message{"close": value}); err != nil {
+			t.Errorf("Did not expect an error for %v, got %s", value, err)
+		}
+		if s.Close != expected {
+			t.Errorf("Expected the close code %d for %v, got %d", expected, value, s.Close)
+		}
+	}
+}
+
+func TestSetWrongFormat(t *testing.T) {
+	for _, tt := range []struct {
+		message Messager
+		raw     Message
+	}{
+		{&RequestMessage{}, Message{"client": []interface{}{"host"}}},
+		{&RequestMessage{}, Message{"headers": "no list"}},
+		{&ResponseMessage{}, Message{"status": "200", "more_content": false}},
+		{&DisconnectionMessage{}, Message{"code": 10.5}},
+		{&RequestBodyChunkMessage{}, Message{"closed": "yes"}},
+	} {
+		if err := tt.message.Set(tt.raw); err == nil {
+			t.Errorf("Expected an error when setting %v to %T", tt.raw, tt.message)
+		}
+	}
+}
@@ -0,0 +1,126 @@
+package redis
+
+import (
+	"bytes"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"time"
+)
+
+const fernetVersion = 0x80
+
+// fernetKey is a key as defined in the fernet spec
+// (https://github.com/fernet/spec). The first half is used to sign the token,
+// the second half to encrypt the message.
+type fernetKey [32]byte
+
+// fernet encrypts and decrypts messages in the same way as the
+// symmetric_encryption_keys of channels_redis. The messages are encrypted with
+// the first key. All keys are tried to decrypt a message, so keys can be
+// rotated.
+type fernet struct {
+	keys []fernetKey
+}
+
+// newFernet creates a fernet from the keys. Like channels_redis, the keys are
+// hashed with sha256 to get a key with the right length.
+func newFernet(keys []string) *fernet {
+	f := &fernet{keys: make([]fernetKey, len(keys))}
+	for i, key := range keys {
+		f.keys[i] = sha256.Sum256([]byte(key))
+	}
+	return f
+}
+
+// encrypt creates a fernet token from the message with the first key.
+func (f *fernet) encrypt(message []byte) ([]byte, error) {
+	iv := make([]byte, aes.BlockSize)
+	if _, err := io.ReadFull(rand.Reader, iv); err != nil {
+		return nil, fmt.Errorf("can not create an iv: %s", err)
+	}
+	return f.keys[0].encrypt(message, time.Now(), iv)
+}
+
+// decrypt returns the message from a fernet token. It uses the first key that
+// fits to the token.
+func (f *fernet) decrypt(token []byte) ([]byte, error) {
+	raw := make([]byte, base64.URLEncoding.DecodedLen(len(token)))
+	n, err := base64.URLEncoding.Decode(raw, token)
+	if err != nil {
+		return nil, fmt.Errorf("message is not encrypted: %s", err)
+	}
+	raw = raw[:n]
+
+	if len(raw) < 1+8+aes.BlockSize+sha256.Size || raw[0] != fernetVersion {
+		return nil, fmt.Errorf("message is not encrypted")
+	}
+	for _, key := range f.keys {
+		if message, ok := key.decrypt(raw); ok {
+			return message, nil
+		}
+	}
+	return nil, fmt.Errorf("can not decrypt message with any of the keys")
+}
+
+// encrypt creates a fernet token at the time now with the given iv.
+func (k fernetKey) encrypt(message []byte, now time.Time, iv []byte) ([]byte, error) {
+	block, err := aes.NewCipher(k[16:])
+	if err != nil {
+		return nil, err
+	}
+
+	// Pad the message with PKCS #7
+	padding := aes.BlockSize - len(message)%aes.BlockSize
+	plain := append(append([]byte{}, message...), bytes.Repeat([]byte{byte(padding)}, padding)...)
+
+	token := make([]byte, 1+8+aes.BlockSize, 1+8+aes.BlockSize+len(plain)+sha256.Size)
+	token[0] = fernetVersion
+	binary.BigEndian.PutUint64(token[1:9], uint64(now.Unix()))
+	copy(token[9:], iv)
+	ciphertext := make([]byte, len(plain))
+	cipher.NewCBCEncrypter(block, iv).CryptBlocks(ciphertext, plain)
+	token = append(token, ciphertext...)
+
+	mac := hmac.New(sha256.New, k[:16])
+	mac.Write(token)
+	token = mac.Sum(token)
+
+	encoded := make([]byte, base64.URLEncoding.EncodedLen(len(token)))
+	base64.URLEncoding.Encode(encoded, token)
+	return encoded, nil
+}
+
+// decrypt returns the message from a base64 decoded token. It returns false, if
+// the token was not signed with this key.
+func (k fernetKey) decrypt(token []byte) ([]byte, bool) {
+	signed, signature := token[:len(token)-sha256.Size], token[len(token)-sha256.Size:]
+	mac := hmac.New(sha256.New, k[:16])
+	mac.Write(signed)
+	if !hmac.Equal(mac.Sum(nil), signature) {
+		return nil, false
+	}
+
+	iv, ciphertext := signed[9:9+aes.BlockSize], signed[9+aes.BlockSize:]
+	if len(ciphertext) == 0 || len(ciphertext)%aes.BlockSize != 0 {
+		return nil, false
+	}
+	block, err := aes.NewCipher(k[16:])
+	if err != nil {
+		return nil, false
+	}
+	plain := make([]byte, len(ciphertext))
+	cipher.NewCBCDecrypter(block, iv).CryptBlocks(plain, ciphertext)
+
+	padding := int(plain[len(plain)-1])
+	if padding == 0 || padding > aes.BlockSize {
+		return nil, false
+	}
+	return plain[:len(plain)-padding], true
+}
@@ -0,0 +1,60 @@
+package redis
+
+import (
+	"encoding/base64"
+	"testing"
+	"time"
+)
+
+func TestFernetSpec(t *testing.T) {
+	// Test vector from https://github.com/fernet/spec/blob/master/generate.json
+	secret, _ := base64.URLEncoding.DecodeString("cw_0x689RpI-jtRR7oE8h_eQsKImvJapLeSbXpwF4e4=")
+	var key fernetKey
+	copy(key[:], secret)
+	now, _ := time.Parse(time.RFC3339, "1985-10-26T01:20:00-07:00")
+	iv := []byte{0, 1, 2, 3, 4, 5, 6, 7, 8, 9, 10, 11, 12, 13, 14, 15}
+	expected := "gAAAAAAdwJ6wAAECAwQFBgcICQoLDA0ODy021cpGVWKZ_eEwCGM4BLLF_5CV9dOPmrhuVUPgJobwOz7JcbmrR64jVmpU4IwqDA=="
+
+	token, err := key.encrypt([]byte("hello"), now, iv)
+	if err != nil {
+		t.Fatalf("Did not expect an error, got %s", err)
+	}
+	if string(token) != expected {
+		t.Errorf("Expected the token %s, got %s", expected, token)
+	}
+
+	f := &fernet{keys: []fernetKey{key}}
+	message, err := f.decrypt([]byte(expected))
+	if err != nil {
+		t.Fatalf("Did not expect an error, got %s", err)
+	}
+	if string(message) != "hello" {
+		t.Errorf("Expected the message hello, got %s", message)
+	}
+}
+
+func TestFernetKeyRotation(t *testing.T) {
+	old := newFernet([]string{"old key"})
+	token, err := old.encrypt([]byte("my message"))
+	if err != nil {
+		t.Fatalf("Did not expect an error, got %s", err)
+	}
+
+	// A message encrypted with an old key can be decrypted after a new key was
+	// added in front.
+	rotated := newFernet([]string{"new key", "old key"})
+	message, err := rotated.decrypt(token)
+	if err != nil {
+		t.Errorf("Did not expect an error, got %s", err)
+	}
+	if string(message) != "my message" {
+		t.Errorf("Expected the message \"my message\", got %s", message)
+	}
+
+	if _, err := newFernet([]string{"new key"}).decrypt(token); err == nil {
+		t.Errorf("Expected an error when decrypting with the wrong key")
+	}
+	if _, err := rotated.decrypt([]byte("not a token")); err == nil {
+		t.Errorf("Expected an error when decrypting a plain message")
+	}
+}
@@ -1,22 +1,253 @@
 package redis
 
 import (
+	"fmt"
+	"hash/crc32"
+	"math/rand"
+	"strings"
 	"time"
 
+	"github.com/ostcar/geiss/asgi"
+
 	"github.com/garyburd/redigo/redis"
 )
 
-// RedisPool is a pool of redis connections
-var redisPool *redis.Pool
-
-// CreateRedisPool sets the redis pool to connect to the host.
-func CreateRedisPool(host string) {
-	redisPool = &redis.Pool{
+// CreateRedisPool creates a pool of redis connections to the host. The host can
+// be in the form HOST:PORT or a redis://, rediss://, unix:// or sentinel://
+// url. maxActive is the number of connections that can be open at the same
+// time.
+func CreateRedisPool(host string, maxActive int) (*redis.Pool, error) {
+	config, err := parseAddress(host)
+	if err != nil {
+		return nil, err
+	}
+	pool := &redis.Pool{
 		MaxIdle:     3,
 		IdleTimeout: 240 * time.Second,
-		// Use a third of the openfiles limit for redis connection
-		MaxActive: int(getOpenFilesLimit() / 3),
-		Wait:      true,
-		Dial:      func() (redis.Conn, error) { return redis.Dial("tcp", host) },
+		MaxActive:   maxActive,
+		Wait:        true,
+		Dial:        config.dial,
+	}
+	if config.master != "" {
+		// Connections to a master can point to a replica after a failover. Test
+		// them, when they were not used for some time.
+		pool.TestOnBorrow = func(conn redis.Conn, t time.Time) error {
+			if time.Since(t) < time.Second {
+				return nil
+			}
+			return checkMaster(conn)
+		}
+	}
+	return pool, nil
+}
+
+// Time between two checks of all hosts, when a blocking receive waits for
+// channels on more then one host.
+const shardPollInterval = 50 * time.Millisecond
+
+// hostRing is a list of redis hosts. The channels are sharded across the hosts.
+type hostRing struct {
+	hosts []string
+	pools []*redis.Pool
+
+	// codec encodes the messages.
+	codec asgi.Codec
+
+	// If crypter is set, then the messages are encrypted in redis.
+	crypter *fernet
+}
+
+// newHostRing creates a redis pool for each host. If hosts is empty, then the
+// default redis host is used.
+func newHostRing(hosts []string) (hostRing, error) {
+	if len(hosts) == 0 {
+		hosts = []string{":6379"}
+	}
+
+	// Use a third of the openfiles limit for redis connection
+	maxActive := int(getOpenFilesLimit()/3) / len(hosts)
+	pools := make([]*redis.Pool, len(hosts))
+	for i, host := range hosts {
+		pool, err := CreateRedisPool(host, maxActive)
+		if err != nil {
+			return hostRing{}, fmt.Errorf("can not use the redis host %s: %s", host, err)
+		}
+		pools[i] = pool
+	}
+	return hostRing{hosts: hosts, pools: pools, codec: asgi.MsgpackCodec{}}, nil
+}
+
+// consistentHash returns the index of the host for a value. It uses the same
+// algorithm as channels_redis, so both find the same host for a channel.
+func (h hostRing) consistentHash(value string) int {
+	if len(h.pools) == 1 {
+		return 0
+	}
+	bigval := crc32.ChecksumIEEE([]byte(value)) & 0xfff
+	ringDivisor := 4096 / float64(len(h.pools))
+	return int(float64(bigval) / ringDivisor)
+}
+
+// shard returns the index of the host for a channel. All process specific
+// channels of one process (the part until the "!") are on the same host.
+func (h hostRing) shard(channel string) int {
+	if i := strings.Index(channel, "!"); i >= 0 {
+		channel = channel[:i+1]
+	}
+	return h.consistentHash(channel)
+}
+
+// receive groups the channels by the host they are on and calls fn for the
+// hosts until fn returns true.
+//
+// If all channels are on one host, then fn can block on this host. If they are
+// on more then one host, then all hosts are asked for a message without
+// blocking. A blocking command on one host would not see the messages on the
+// other hosts. So if block is true, the hosts are asked again every
+// shardPollInterval until there is a message or blPopTimeout is over.
+func (h hostRing) receive(
+	channels []string,
+	block bool,
+	fn func(index int, channels []string, block bool) (bool, error)) error {
+
+	// Group the channels by the host they are on.
+	shards := make(map[int][]string)
+	for _, channel := range channels {
+		index := h.shard(channel)
+		shards[index] = append(shards[index], channel)
+	}
+
+	if len(shards) == 1 {
+		for index := range shards {
+			_, err := fn(index, shards[index], block)
+			return err
+		}
+	}
+
+	deadline := time.Now().Add(blPopTimeout * time.Second)
+	for {
+		for _, index := range rand.Perm(len(h.pools)) {
+			if _, ok := shards[index]; !ok {
+				continue
+			}
+			found, err := fn(index, shards[index], false)
+			if err != nil || found {
+				return err
+			}
+		}
+		if !block || time.Now().After(deadline) {
+			// Nothing to receive
+			return nil
+		}
+		time.Sleep(shardPollInterval)
+	}
+}
+
+// SetCodec sets the codec to encode the messages. The default is msgpack, which
+// is used by channels_redis.
+func (h *hostRing) SetCodec(codec asgi.Codec) {
+	h.codec = codec
+}
+
+// SetSymmetricEncryptionKeys encrypts all messages with the first key. All
+// keys are used to decrypt the messages, so old keys can be kept for some time
+// after a new key was added. The encryption is compatible with the option
+// symmetric_encryption_keys of channels_redis. Without keys, the messages are
+// not encrypted.
+func (h *hostRing) SetSymmetricEncryptionKeys(keys []string) {
+	if len(keys) == 0 {
+		h.crypter = nil
+		return
+	}
+	h.crypter = newFernet(keys)
+}
+
+// encodeMessage encodes a message with the codec and encrypts it, if
+// encryption keys are set.
+func (h hostRing) encodeMessage(message asgi.Message) ([]byte, error) {
+	b, err := h.codec.Encode(message)
+	if err != nil {
+		return nil, err
+	}
+	if h.crypter == nil {
+		return b, nil
+	}
+	return h.crypter.encrypt(b)
+}
+
+// decodeMessage decodes a message that was received on channel. It returns the
+// channel name that is saved in the message, if there is one.
+func (h hostRing) decodeMessage(channel string, b []byte) (string, asgi.Message, error) {
+	var err error
+	if h.crypter != nil {
+		if b, err = h.crypter.decrypt(b); err != nil {
+			return "", nil, fmt.Errorf("can not decrypt message on channel %s: %s", channel, err)
+		}
+	}
+
+	// b is an encoded message. First decode it.
+	message, err := h.codec.Decode(b)
+	if err != nil {
+		return "", nil, err
+	}
+
+	// check if there is a channel information in the raw message
+	if v, ok := message["__asgi_channel__"]; ok {
+		channel = v.(string)
+		delete(message, "__asgi_channel__")
+	}
+	return channel, message, nil
+}
+
+// scanKeys calls fn with all keys on one host that start with the prefix.
+func scanKeys(conn redis.Conn, prefix string, fn func(keys []string) error) error {
+	pattern := globEscaper.Replace(prefix) + "*"
+	cursor := 0
+	for {
+		values, err := redis.Values(conn.Do("SCAN", cursor, "MATCH", pattern, "COUNT", 1000))
+		if err != nil {
+			return fmt.Errorf("redis error: %s", err)
+		}
+		cursor, err = redis.Int(values[0], nil)
+		if err != nil {
+			return fmt.Errorf("redis error: %s", err)
+		}
+		keys, err := redis.Strings(values[1], nil)
+		if err != nil {
+			return fmt.Errorf("redis error: %s", err)
+		}
+		if len(keys) > 0 {
+			if err = fn(keys); err != nil {
+				return err
+			}
+		}
+		if cursor == 0 {
+			return nil
+		}
+	}
+}
+
+// globEscaper escapes the special characters of a redis glob pattern.
+var globEscaper = strings.NewReplacer(`\`, `\\`, "*", `\*`, "?", `\?`, "[", `\[`, "]", `\]`)
+
+// flushKeys removes all keys that start with the prefix from all hosts.
+func (h hostRing) flushKeys(prefix string) (err error) {
+	for _, pool := range h.pools {
+		conn := pool.Get()
+		err = scanKeys(conn, prefix, func(keys []string) error {
+			args := make([]interface{}, len(keys))
+			for i, key := range keys {
+				args[i] = key
+			}
+			if _, err := conn.Do("DEL", args...); err != nil {
+				return fmt.Errorf("redis error: %s", err)
+			}
+			return nil
+		})
+		conn.Close()
+		if err != nil {
+			return err
+		}
 	}
+	return nil
 }
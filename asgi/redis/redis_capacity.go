@@ -0,0 +1,56 @@
+package redis
+
+import (
+	"fmt"
+	"path"
+	"strconv"
+	"strings"
+)
+
+// CapacityRule sets the capacity of all channels that match the glob pattern.
+// The pattern uses the same syntax as the channel_capacity option of
+// channels_redis, for example "websocket.send*" or "http.request.body?*".
+type CapacityRule struct {
+	Pattern  string
+	Capacity int
+}
+
+// ParseCapacityRule parses a rule in the form PATTERN=CAPACITY.
+func ParseCapacityRule(rule string) (CapacityRule, error) {
+	i := strings.LastIndex(rule, "=")
+	if i <= 0 {
+		return CapacityRule{}, fmt.Errorf("capacity rule %s has to be in the form PATTERN=CAPACITY", rule)
+	}
+	capacity, err := strconv.Atoi(rule[i+1:])
+	if err != nil || capacity <= 0 {
+		return CapacityRule{}, fmt.Errorf("invalid capacity in rule %s", rule)
+	}
+	if _, err := path.Match(rule[:i], ""); err != nil {
+		return CapacityRule{}, fmt.Errorf("invalid pattern in rule %s: %s", rule, err)
+	}
+	return CapacityRule{Pattern: rule[:i], Capacity: capacity}, nil
+}
+
+// SetChannelCapacity sets the capacity for the channels that match one of the
+// rules. The first matching rule is used. Channels that do not match any rule
+// use the capacity given to NewChannelLayer.
+func (r *ChannelLayer) SetChannelCapacity(rules []CapacityRule) error {
+	for _, rule := range rules {
+		if _, err := path.Match(rule.Pattern, ""); err != nil {
+			return fmt.Errorf("invalid pattern %s: %s", rule.Pattern, err)
+		}
+	}
+	r.capacityRules = rules
+	return nil
+}
+
+// channelCapacity returns the capacity of a channel.
+func (r *ChannelLayer) channelCapacity(channel string) int {
+	for _, rule := range r.capacityRules {
+		// The pattern was checked in SetChannelCapacity, so there is no error.
+		if ok, _ := path.Match(rule.Pattern, channel); ok {
+			return rule.Capacity
+		}
+	}
+	return r.capacity
+}
@@ -0,0 +1,64 @@
+package redis
+
+import (
+	"testing"
+
+	"github.com/ostcar/geiss/asgi"
+)
+
+func TestParseCapacityRule(t *testing.T) {
+	rule, err := ParseCapacityRule("websocket.send*=20")
+	if err != nil {
+		t.Errorf("Did not expect an error, got %s", err)
+	}
+	if rule != (CapacityRule{Pattern: "websocket.send*", Capacity: 20}) {
+		t.Errorf("Got a wrong rule: %+v", rule)
+	}
+
+	for _, wrong := range []string{"http.request", "=20", "http.request=many", "http.request=0", "[http=5"} {
+		if _, err := ParseCapacityRule(wrong); err == nil {
+			t.Errorf("Expected an error for %s", wrong)
+		}
+	}
+}
+
+func TestChannelCapacity(t *testing.T) {
+	c, err := NewChannelLayer(0, nil, "testchannelcapacity:", 10, 0)
+	if err != nil {
+		t.Fatalf("Can not create the channel layer: %s", err)
+	}
+	defer c.Flush()
+	err = c.SetChannelCapacity([]CapacityRule{
+		{"http.request", 200},
+		{"http.request.body?*", 5},
+		{"websocket.send*", 1},
+		{"websocket.send!special", 50},
+	})
+	if err != nil {
+		t.Fatalf("Did not expect an error, got %s", err)
+	}
+
+	for channel, expected := range map[string]int{
+		"http.request":            200,
+		"http.request.body?abc":   5,
+		"websocket.send!abc":      1,
+		"websocket.send!special":  1,
+		"websocket.receive":       10,
+		"http.request.somethings": 10,
+	} {
+		if got := c.channelCapacity(channel); got != expected {
+			t.Errorf("Expected the capacity %d for %s, got %d", expected, channel, got)
+		}
+	}
+
+	if err := c.Send("websocket.send!abc", asgi.Message{}); err != nil {
+		t.Errorf("Did not expect an error, got %s", err)
+	}
+	if err := c.Send("websocket.send!abc", asgi.Message{}); !asgi.IsChannelFullError(err) {
+		t.Errorf("Expected a channel full error, got %v", err)
+	}
+
+	if err := c.SetChannelCapacity([]CapacityRule{{"[http", 5}}); err == nil {
+		t.Errorf("Expected an error for an invalid pattern")
+	}
+}
@@ -5,70 +5,143 @@ package redis
 
 import (
 	"fmt"
-	"log"
+	"math/rand"
 	"strings"
+	"time"
 
 	"github.com/ostcar/geiss/asgi"
 
-	msgpack "gopkg.in/vmihailenco/msgpack.v2"
-
 	"github.com/garyburd/redigo/redis"
 	uuid "github.com/satori/go.uuid"
 )
 
-// Sets the time in seconds that Receive() with block=true should wait for a message.
-const blPopTimeout = 3
+const (
+	// Sets the time in seconds that Receive() with block=true should wait for a message.
+	blPopTimeout = 3
+
+	// Number of seconds that are used to calculate the messages per second.
+	statisticsWindow = 10
+
+	// Seconds until the statistics of a channel are removed, when no message
+	// was send to it.
+	statisticsExpiry = 86400
+)
 
-var luaChanSend *redis.Script
+var luaChanSend, luaReceive, luaPending *redis.Script
 
 func init() {
+	// KEYS are the message key, the channel key, the global message counter, the
+	// global full counter, the global rate counter, the channel message counter,
+	// the channel full counter and the channel rate counter.
 	luaChanSend = redis.NewScript(
-		2,
+		8,
 		`
 		if redis.call('llen', KEYS[2]) >= tonumber(ARGV[3]) then
+		    redis.call('incr', KEYS[4])
+		    redis.call('incr', KEYS[7])
+		    redis.call('expire', KEYS[7], ARGV[4])
 		    return redis.error_reply("full")
 		end
 		redis.call('set', KEYS[1], ARGV[1])
 		redis.call('expire', KEYS[1], ARGV[2])
 		redis.call('rpush', KEYS[2], KEYS[1])
 		redis.call('expire', KEYS[2], ARGV[2] + 1)
+		redis.call('incr', KEYS[3])
+		redis.call('incr', KEYS[5])
+		redis.call('expire', KEYS[5], ARGV[5] + 1)
+		redis.call('incr', KEYS[6])
+		redis.call('expire', KEYS[6], ARGV[4])
+		redis.call('incr', KEYS[8])
+		redis.call('expire', KEYS[8], ARGV[5] + 1)
+	`)
+
+	// luaReceive pops the first message from the first channel in KEYS that has
+	// one. It returns the channel key and the message and deletes the message
+	// key. Message keys that are expired are skipped. If ARGV[1] is given, it
+	// is used as message key, that was already popped from KEYS[1].
+	luaReceive = redis.NewScript(
+		-1,
+		`
+		local messageKey = ARGV[1]
+		for _, key in ipairs(KEYS) do
+		    if not messageKey then
+		        messageKey = redis.call('lpop', key)
+		    end
+		    while messageKey do
+		        local content = redis.call('get', messageKey)
+		        redis.call('del', messageKey)
+		        if content then
+		            return {key, content}
+		        end
+		        messageKey = redis.call('lpop', key)
+		    end
+		end
+		return false
+	`)
+
+	// luaPending returns the number of messages in all KEYS, that are lists.
+	luaPending = redis.NewScript(
+		-1,
+		`
+		local count = 0
+		for _, key in ipairs(KEYS) do
+		    local length = redis.pcall('llen', key)
+		    if type(length) == 'number' then
+		        count = count + length
+		    end
+		end
+		return count
 	`)
 }
 
 // ChannelLayer is the main type to use as redis channel layer.
 type ChannelLayer struct {
-	prefix   string
-	expiry   int
-	host     string
-	capacity int
+	hostRing
+	prefix      string
+	expiry      int
+	capacity    int
+	groupExpiry int
+
+	// capacityRules overwrite the capacity for some channels.
+	capacityRules []CapacityRule
+
+	// If offloader is set, then big messages are stored outside of the channel.
+	offloader *offloader
 }
 
-// NewChannelLayer creates a new RedisChannelLayer
-func NewChannelLayer(expiry int, host string, prefix string, capacity int) *ChannelLayer {
-	// TODO: Work with more then one host
+// NewChannelLayer creates a new RedisChannelLayer. If more then one host is
+// given, then the channels are sharded across the hosts. It returns an error,
+// if one of the hosts is invalid.
+func NewChannelLayer(expiry int, hosts []string, prefix string, capacity int, groupExpiry int) (*ChannelLayer, error) {
 	if expiry == 0 {
 		expiry = 60
 	}
-	if host == "" {
-		host = ":6379"
-	}
 	if prefix == "" {
 		prefix = "asgi:"
 	}
 	if capacity == 0 {
 		capacity = 100
 	}
-	if redisPool != nil {
-		log.Fatalln("Redis pool already set. Can not create a second one.")
+	if groupExpiry == 0 {
+		groupExpiry = 86400
 	}
-	CreateRedisPool(host)
-	return &ChannelLayer{prefix: prefix, expiry: expiry, host: host, capacity: capacity}
+	ring, err := newHostRing(hosts)
+	if err != nil {
+		return nil, err
+	}
+	return &ChannelLayer{
+		hostRing:    ring,
+		prefix:      prefix,
+		expiry:      expiry,
+		capacity:    capacity,
+		groupExpiry: groupExpiry,
+	}, nil
 }
 
 // NewChannel creates a new channelname
 func (r *ChannelLayer) NewChannel(channelPrefix string) (channel string, err error) {
 	var exists int64
-	conn := redisPool.Get()
+	conn := r.pools[r.shard(channelPrefix)].Get()
 	defer conn.Close()
 
 	for {
@@ -92,21 +165,45 @@ func (r *ChannelLayer) NewChannel(channelPrefix string) (channel string, err err
 
 // Send sends a message to a specific channel
 func (r *ChannelLayer) Send(channel string, message asgi.Message) (err error) {
-	conn := redisPool.Get()
+	conn := r.pools[r.shard(channel)].Get()
 	defer conn.Close()
 
+	// Messages to process specific channels are send to the non local channel.
+	name, message := asgi.ProcessLocal(channel, message)
 	messageKey := r.prefix + uuid.NewV4().String()
-	channelKey := r.prefix + channel
+	channelKey := r.prefix + name
 
-	// Encodes a message to the msgpack format.
-	bytes, err := msgpack.Marshal(message)
+	// Encodes the message with the codec.
+	bytes, err := r.encodeMessage(message)
 	if err != nil {
-		return fmt.Errorf("can not encode message %v, got %s", message, err)
+		return err
+	}
+	if bytes, err = r.offload(conn, channel, bytes); err != nil {
+		return err
 	}
 
-	// Use the lua script to set both keys
-	_, err = luaChanSend.Do(conn, messageKey, channelKey, bytes, r.expiry, r.capacity)
+	// Use the lua script to set both keys and to count the message
+	now := time.Now().Unix()
+	stats := r.statisticsKey(name)
+	_, err = luaChanSend.Do(
+		conn,
+		messageKey,
+		channelKey,
+		r.statisticsKey("")+"messages",
+		r.statisticsKey("")+"full",
+		fmt.Sprintf("%srate:%d", r.statisticsKey(""), now),
+		stats+"messages",
+		stats+"full",
+		fmt.Sprintf("%srate:%d", stats, now),
+		bytes,
+		r.expiry,
+		r.channelCapacity(channel),
+		statisticsExpiry,
+		statisticsWindow,
+	)
 	if err != nil {
+		// The message was not sent, so nobody will load the offloaded content.
+		r.discard(conn, bytes)
 		if err.Error() == "full" {
 			return asgi.ChannelFullError{
 				Channel: channel,
@@ -117,83 +214,240 @@ func (r *ChannelLayer) Send(channel string, message asgi.Message) (err error) {
 	return nil
 }
 
-func lpopMany(
-	prefix string,
+// Receive reads from a channel and returns a raw message objekt
+func (r *ChannelLayer) Receive(
 	channels []string,
-	conn redis.Conn,
-) (channel, message string, err error) {
-	// TODO: use lua
-	for _, channel = range channels {
-		message, err = redis.String(conn.Do("LPOP", prefix+channel))
-		if err == redis.ErrNil {
-			// The channel is empty
-			continue
-		} else {
-			// An error happened or a value was returned
-			return channel, message, err
-		}
+	block bool) (channel string, message asgi.Message, err error) {
+
+	err = r.receive(channels, block, func(index int, channels []string, block bool) (bool, error) {
+		channel, message, err = r.receiveShard(index, channels, block)
+		return channel != "", err
+	})
+	if err != nil {
+		return "", nil, err
 	}
-	// Did not receive anything
-	return "", "", redis.ErrNil
+	return channel, message, nil
 }
 
-// Receive reads from a channel and returns a raw message objekt
-func (r *ChannelLayer) Receive(
+// receiveShard reads from channels that are on the same host.
+func (r *ChannelLayer) receiveShard(
+	index int,
 	channels []string,
 	block bool) (channel string, message asgi.Message, err error) {
 
-	conn := redisPool.Get()
+	conn := r.pools[index].Get()
 	defer conn.Close()
 
-	var messageKey string
-	var args []interface{}
-
-	if block {
-		// If block is True, then this method should wait until there is a message to
-		// receive.
+	// Shuffle the channels, so the first channels do not starve the others.
+	keys := make([]interface{}, len(channels))
+	for i, j := range rand.Perm(len(channels)) {
+		keys[i] = r.prefix + channels[j]
+	}
 
-		// First, build the arguments for the BLPOP redis command.
-		for _, channel := range channels {
-			args = append(args, r.prefix+channel)
-		}
-		args = append(args, blPopTimeout)
-
-		// Call the BLPOP redis command.
-		var v []string
-		v, err = redis.Strings(conn.Do("BLPOP", args...))
-		if err == redis.ErrNil {
-			// Got timeout. Nothing to receive
-			return "", nil, nil
-		} else if err != nil {
-			return "", nil, err
-		}
-		channel = strings.TrimPrefix(v[0], r.prefix)
-		messageKey = v[1]
-	} else {
-		channel, messageKey, err = lpopMany(r.prefix, channels, conn)
-		if err == redis.ErrNil {
-			// Nothing to receive
-			return "", nil, nil
-		} else if err != nil {
-			return "", nil, err
+	// Try to get a message without blocking.
+	v, err := redis.Values(luaReceive.Do(conn, append([]interface{}{len(keys)}, keys...)...))
+	if err == redis.ErrNil && block {
+		// If block is True, then this method should wait until there is a message
+		// to receive. Blocking commands can not be used inside a lua script, so
+		// use BLPOP and fetch the message afterwards.
+		var popped []interface{}
+		popped, err = redis.Values(conn.Do("BLPOP", append(keys, blPopTimeout)...))
+		if err == nil {
+			v, err = redis.Values(luaReceive.Do(conn, 1, popped[0], popped[1]))
 		}
 	}
+	if err == redis.ErrNil {
+		// Nothing to receive or got timeout
+		return "", nil, nil
+	} else if err != nil {
+		return "", nil, fmt.Errorf("redis luaReceive error: %s", err)
+	}
 
-	// If we are here, there is a channel with a message in messageKey
-	b, err := redis.Bytes(conn.Do("GET", messageKey))
+	channelKey, err := redis.String(v[0], nil)
 	if err != nil {
+		return "", nil, fmt.Errorf("redis luaReceive error: %s", err)
+	}
+	b, err := redis.Bytes(v[1], nil)
+	if err != nil {
+		return "", nil, fmt.Errorf("redis luaReceive error: %s", err)
+	}
+	if b, err = r.load(conn, b); err != nil {
 		return "", nil, err
 	}
+	return r.decodeMessage(strings.TrimPrefix(channelKey, r.prefix), b)
+}
+
+// groupKey returns the redis key of a group. It is the same key that
+// channels_redis uses.
+func (r *ChannelLayer) groupKey(group string) string {
+	return fmt.Sprintf("%s:group:%s", r.prefix, group)
+}
 
-	// b is an encoded message. First decode it.
-	if err = msgpack.Unmarshal(b, &message); err != nil {
-		return "", nil, fmt.Errorf("can not decode message %s, got %s", b, err)
+// GroupAdd adds a channel to a group.
+func (r *ChannelLayer) GroupAdd(group, channel string) (err error) {
+	conn := r.pools[r.consistentHash(group)].Get()
+	defer conn.Close()
+
+	// The score of each channel is the time, when it was added. It is used to
+	// remove expired channels from the group.
+	groupKey := r.groupKey(group)
+	now := float64(time.Now().UnixNano()) / float64(time.Second)
+	conn.Send("MULTI")
+	conn.Send("ZADD", groupKey, now, channel)
+	conn.Send("EXPIRE", groupKey, r.groupExpiry)
+	if _, err = conn.Do("EXEC"); err != nil {
+		return fmt.Errorf("redis error: %s", err)
 	}
+	return nil
+}
+
+// GroupDiscard removes a channel from a group.
+func (r *ChannelLayer) GroupDiscard(group, channel string) (err error) {
+	conn := r.pools[r.consistentHash(group)].Get()
+	defer conn.Close()
 
-	// check if there is a channel information in the raw message
-	if v, ok := message["__asgi_channel__"]; ok {
-		channel = v.(string)
-		delete(message, "__asgi_channel__")
+	if _, err = conn.Do("ZREM", r.groupKey(group), channel); err != nil {
+		return fmt.Errorf("redis error: %s", err)
+	}
+	return nil
+}
+
+// groupChannels returns all channels of a group that are not expired.
+func (r *ChannelLayer) groupChannels(group string) (channels []string, err error) {
+	conn := r.pools[r.consistentHash(group)].Get()
+	defer conn.Close()
+
+	// Remove the expired channels from the group.
+	groupKey := r.groupKey(group)
+	expired := time.Now().Unix() - int64(r.groupExpiry)
+	if _, err = conn.Do("ZREMRANGEBYSCORE", groupKey, 0, expired); err != nil {
+		return nil, fmt.Errorf("redis error: %s", err)
+	}
+
+	channels, err = redis.Strings(conn.Do("ZRANGE", groupKey, 0, -1))
+	if err != nil {
+		return nil, fmt.Errorf("redis error: %s", err)
+	}
+	return channels, nil
+}
+
+// SendGroup sends a message to all channels of a group.
+func (r *ChannelLayer) SendGroup(group string, message asgi.Message) (err error) {
+	channels, err := r.groupChannels(group)
+	if err != nil {
+		return err
+	}
+
+	for _, channel := range channels {
+		err = r.Send(channel, message)
+		if err != nil && !asgi.IsChannelFullError(err) {
+			return err
+		}
+	}
+	return nil
+}
+
+// Flush removes all keys of the channel layer from all hosts and all offloaded
+// files.
+func (r *ChannelLayer) Flush() (err error) {
+	if err = r.flushKeys(r.prefix); err != nil {
+		return err
+	}
+	return r.offloader.flush()
+}
+
+// statisticsKey returns the prefix of the redis keys that hold the statistics
+// of a channel. If the channel is an empty string, then it returns the prefix
+// of the global statistics.
+//
+// Process specific channels and single reader channels are counted together
+// with all other channels of the same process or reader. Otherwise each
+// response channel would create its own keys.
+func (r *ChannelLayer) statisticsKey(channel string) string {
+	if channel == "" {
+		return r.prefix + "stats::"
+	}
+	if i := strings.IndexAny(channel, "!?"); i >= 0 {
+		channel = channel[:i+1]
+	}
+	return r.prefix + "stats:" + channel + ":"
+}
+
+// readStatistics reads the counters of one statistics key from one host and
+// adds them to stats.
+func (r *ChannelLayer) readStatistics(conn redis.Conn, key string, stats *asgi.Statistics) error {
+	now := time.Now().Unix()
+	args := []interface{}{key + "messages", key + "full"}
+	for i := int64(1); i <= statisticsWindow; i++ {
+		args = append(args, fmt.Sprintf("%srate:%d", key, now-i))
+	}
+
+	values, err := redis.Int64s(conn.Do("MGET", args...))
+	if err != nil {
+		return fmt.Errorf("redis error: %s", err)
+	}
+	stats.MessagesCount += values[0]
+	stats.ChannelFullCount += values[1]
+	var sent int64
+	for _, v := range values[2:] {
+		sent += v
+	}
+	stats.MessagesPerSecond += float64(sent) / statisticsWindow
+	return nil
+}
+
+// GlobalStatistics returns the statistics of all channels.
+func (r *ChannelLayer) GlobalStatistics() (stats asgi.Statistics, err error) {
+	for _, pool := range r.pools {
+		conn := pool.Get()
+		err = r.readStatistics(conn, r.statisticsKey(""), &stats)
+		if err == nil {
+			err = scanKeys(conn, r.prefix, func(keys []string) error {
+				// The first argument of luaPending is the number of keys.
+				args := []interface{}{len(keys)}
+				for _, key := range keys {
+					args = append(args, key)
+				}
+				pending, err := redis.Int64(luaPending.Do(conn, args...))
+				if err != nil {
+					return fmt.Errorf("redis luaPending error: %s", err)
+				}
+				stats.MessagesPending += pending
+				return nil
+			})
+		}
+		conn.Close()
+		if err != nil {
+			return asgi.Statistics{}, err
+		}
+	}
+	return stats, nil
+}
+
+// ChannelStatistics returns the statistics of one channel.
+//
+// The counters of process specific channels and single reader channels are
+// the counters of all channels of the same process or reader.
+func (r *ChannelLayer) ChannelStatistics(channel string) (stats asgi.Statistics, err error) {
+	// Single reader channels of the same reader can be on different hosts, so
+	// the counters are read from all hosts.
+	for _, pool := range r.pools {
+		conn := pool.Get()
+		err = r.readStatistics(conn, r.statisticsKey(channel), &stats)
+		conn.Close()
+		if err != nil {
+			return asgi.Statistics{}, err
+		}
+	}
+
+	// Messages to process specific channels are queued in the non local
+	// channel.
+	name, _ := asgi.ProcessLocal(channel, nil)
+	conn := r.pools[r.shard(channel)].Get()
+	defer conn.Close()
+	stats.MessagesPending, err = redis.Int64(conn.Do("LLEN", r.prefix+name))
+	if err != nil {
+		return asgi.Statistics{}, fmt.Errorf("redis error: %s", err)
 	}
-	return
+	return stats, nil
 }
@@ -0,0 +1,246 @@
+package redis
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/garyburd/redigo/redis"
+)
+
+// Timeout to connect and to read from a redis sentinel.
+const sentinelTimeout = time.Second
+
+// dialConfig holds all values that are needed to connect to a redis server.
+type dialConfig struct {
+	network  string
+	address  string
+	password string
+	db       int
+	tls      *tls.Config
+
+	// If master is set, then the address is asked from the sentinels before
+	// each connect.
+	master    string
+	sentinels []string
+}
+
+// parseAddress parses the address of a redis server. It can be in the form
+// HOST:PORT or an url in one of the forms
+//
+//	redis://:PASSWORD@HOST:PORT/DB
+//	rediss://:PASSWORD@HOST:PORT/DB?ca_file=FILE&cert_file=FILE&key_file=FILE
+//	unix://:PASSWORD@/PATH/TO/SOCKET?db=DB
+//	sentinel://:PASSWORD@MASTER/DB?sentinel=HOST:PORT&sentinel=HOST:PORT&tls=true
+//
+// rediss uses a tls connection. The options ca_file, cert_file, key_file and
+// skip_verify are optional. ca_file is a pem file with the certificates that
+// are used to verify the server. cert_file and key_file are a client
+// certificate. If skip_verify is true, then the certificate of the server is
+// not verified.
+//
+// sentinel asks the redis sentinels for the address of the redis master with the
+// name MASTER. The option sentinel can be used more then once. If tls is true,
+// then the connections to the master use tls with the same options as rediss.
+// The connections to the sentinels do not use tls.
+func parseAddress(address string) (c dialConfig, err error) {
+	c.network = "tcp"
+	if !strings.Contains(address, "://") {
+		c.address = address
+		return c, nil
+	}
+
+	u, err := url.Parse(address)
+	if err != nil {
+		return c, fmt.Errorf("invalid redis url %s: %s", address, err)
+	}
+	query := u.Query()
+
+	switch u.Scheme {
+	case "redis", "rediss":
+		c.address = u.Host
+		if _, _, err := net.SplitHostPort(c.address); err != nil {
+			// Use the default port
+			c.address = net.JoinHostPort(u.Host, "6379")
+		}
+		if db := strings.TrimPrefix(u.Path, "/"); db != "" {
+			if c.db, err = strconv.Atoi(db); err != nil {
+				return c, fmt.Errorf("invalid database %s in redis url", db)
+			}
+		}
+
+	case "sentinel":
+		c.master = u.Host
+		c.sentinels = query["sentinel"]
+		if c.master == "" || len(c.sentinels) == 0 {
+			return c, fmt.Errorf("a sentinel url needs a master name and at least one sentinel")
+		}
+		if db := strings.TrimPrefix(u.Path, "/"); db != "" {
+			if c.db, err = strconv.Atoi(db); err != nil {
+				return c, fmt.Errorf("invalid database %s in redis url", db)
+			}
+		}
+
+	case "unix":
+		c.network = "unix"
+		c.address = u.Path
+		if db := query.Get("db"); db != "" {
+			if c.db, err = strconv.Atoi(db); err != nil {
+				return c, fmt.Errorf("invalid database %s in redis url", db)
+			}
+		}
+
+	default:
+		return c, fmt.Errorf("unknown scheme %s in redis url, use redis, rediss, unix or sentinel", u.Scheme)
+	}
+
+	if u.User != nil {
+		// The password can be given with or without a user name.
+		var ok bool
+		if c.password, ok = u.User.Password(); !ok {
+			c.password = u.User.Username()
+		}
+	}
+	if password := query.Get("password"); password != "" {
+		c.password = password
+	}
+
+	switch {
+	case u.Scheme == "rediss":
+		c.tls, err = tlsConfig(u.Hostname(), query)
+	case u.Scheme == "sentinel" && query.Get("tls") != "":
+		var useTLS bool
+		if useTLS, err = strconv.ParseBool(query.Get("tls")); err != nil {
+			return c, fmt.Errorf("invalid value %s for tls", query.Get("tls"))
+		}
+		if useTLS {
+			// The host of the master is not known yet. redigo uses the host of
+			// the address as server name.
+			c.tls, err = tlsConfig("", query)
+		}
+	}
+	if err != nil {
+		return c, err
+	}
+	return c, nil
+}
+
+// tlsConfig creates the tls config for a rediss url.
+func tlsConfig(host string, query url.Values) (*tls.Config, error) {
+	config := &tls.Config{ServerName: host}
+
+	if caFile := query.Get("ca_file"); caFile != "" {
+		pem, err := ioutil.ReadFile(caFile)
+		if err != nil {
+			return nil, fmt.Errorf("can not read ca_file: %s", err)
+		}
+		config.RootCAs = x509.NewCertPool()
+		if !config.RootCAs.AppendCertsFromPEM(pem) {
+			return nil, fmt.Errorf("no certificates found in ca_file %s", caFile)
+		}
+	}
+
+	certFile, keyFile := query.Get("cert_file"), query.Get("key_file")
+	if certFile != "" || keyFile != "" {
+		cert, err := tls.LoadX509KeyPair(certFile, keyFile)
+		if err != nil {
+			return nil, fmt.Errorf("can not load client certificate: %s", err)
+		}
+		config.Certificates = []tls.Certificate{cert}
+	}
+
+	if skip := query.Get("skip_verify"); skip != "" {
+		var err error
+		if config.InsecureSkipVerify, err = strconv.ParseBool(skip); err != nil {
+			return nil, fmt.Errorf("invalid value %s for skip_verify", skip)
+		}
+	}
+	return config, nil
+}
+
+// masterAddress asks the sentinels for the address of the redis master. It
+// uses the first sentinel that knows the master.
+func (c dialConfig) masterAddress() (string, error) {
+	var err error
+	for _, address := range c.sentinels {
+		var conn redis.Conn
+		conn, err = redis.Dial(
+			"tcp",
+			address,
+			redis.DialConnectTimeout(sentinelTimeout),
+			redis.DialReadTimeout(sentinelTimeout),
+			redis.DialWriteTimeout(sentinelTimeout),
+		)
+		if err != nil {
+			continue
+		}
+
+		var master []string
+		master, err = redis.Strings(conn.Do("SENTINEL", "get-master-addr-by-name", c.master))
+		conn.Close()
+		if err == nil && len(master) == 2 {
+			return net.JoinHostPort(master[0], master[1]), nil
+		}
+		if err == redis.ErrNil {
+			err = fmt.Errorf("sentinel %s does not know the master %s", address, c.master)
+		}
+	}
+	return "", fmt.Errorf("can not get the address of the redis master %s: %s", c.master, err)
+}
+
+// checkMaster returns an error, if the connection is not to a redis master.
+// After a failover, the old master becomes a replica.
+func checkMaster(conn redis.Conn) error {
+	role, err := redis.Values(conn.Do("ROLE"))
+	if err != nil {
+		return err
+	}
+	if len(role) == 0 {
+		return fmt.Errorf("got an empty reply from the ROLE command")
+	}
+	if name, _ := redis.String(role[0], nil); name != "master" {
+		return fmt.Errorf("redis server is a %s and not the master", name)
+	}
+	return nil
+}
+
+// dial opens a new connection to the redis server.
+func (c dialConfig) dial() (redis.Conn, error) {
+	if c.master != "" {
+		address, err := c.masterAddress()
+		if err != nil {
+			return nil, err
+		}
+		c.address = address
+	}
+
+	options := []redis.DialOption{redis.DialDatabase(c.db)}
+	if c.password != "" {
+		options = append(options, redis.DialPassword(c.password))
+	}
+	if c.tls != nil {
+		options = append(
+			options,
+			redis.DialUseTLS(true),
+			redis.DialTLSConfig(c.tls),
+			redis.DialTLSSkipVerify(c.tls.InsecureSkipVerify),
+		)
+	}
+	conn, err := redis.Dial(c.network, c.address, options...)
+	if err != nil || c.master == "" {
+		return conn, err
+	}
+
+	// The sentinels could still point to the old master during a failover.
+	if err = checkMaster(conn); err != nil {
+		conn.Close()
+		return nil, fmt.Errorf("redis at %s: %s", c.address, err)
+	}
+	return conn, nil
+}
@@ -0,0 +1,203 @@
+package redis
+
+import (
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/garyburd/redigo/redis"
+	uuid "github.com/satori/go.uuid"
+)
+
+// offloadMarker is the beginning of a message that was stored outside of the
+// channel. The first byte is never used by msgpack and is no valid json or
+// base64, so it can not be the beginning of a normal or an encrypted message.
+var offloadMarker = []byte("\xc1asgi-offload:")
+
+// defaultOffloadChannels are the channels that are offloaded, if no patterns
+// are given to SetOffloading. These are the process specific channels, that
+// are only read by Geiss.
+var defaultOffloadChannels = []string{"*!*"}
+
+// offloader stores big messages outside of the channel. The channel only gets a
+// reference to the message.
+type offloader struct {
+	threshold int
+
+	// Only messages to channels that match one of the glob patterns are
+	// offloaded.
+	patterns []string
+
+	// If dir is empty, then the messages are stored in a separate redis key.
+	// Else they are stored in files in dir.
+	dir string
+
+	mu          sync.Mutex
+	lastCleanup time.Time
+}
+
+// SetOffloading stores messages that are bigger then threshold bytes outside of
+// the channel. If dir is empty, then they are stored in a separate redis key,
+// so they still use the memory of redis. Else they are stored in a file in the
+// directory dir, which has to be shared by all processes that use the channel
+// layer. Receive loads the message again, so offloading is invisible to the
+// receiver. A threshold of 0 disables offloading.
+//
+// Only Geiss and other go processes that use this channel layer can read
+// offloaded messages. So only messages to channels that match one of the glob
+// patterns are offloaded. If no pattern is given, then only messages to
+// process specific channels like the response channels of Geiss are
+// offloaded. Channels that are read by python workers must not match.
+func (r *ChannelLayer) SetOffloading(threshold int, dir string, patterns []string) error {
+	if threshold <= 0 {
+		r.offloader = nil
+		return nil
+	}
+	if len(patterns) == 0 {
+		patterns = defaultOffloadChannels
+	}
+	for _, pattern := range patterns {
+		if _, err := path.Match(pattern, ""); err != nil {
+			return fmt.Errorf("invalid offload pattern %s: %s", pattern, err)
+		}
+	}
+	if dir != "" {
+		if err := os.MkdirAll(dir, 0700); err != nil {
+			return fmt.Errorf("can not create the offload directory: %s", err)
+		}
+	}
+	r.offloader = &offloader{threshold: threshold, patterns: patterns, dir: dir}
+	return nil
+}
+
+// offload stores a message outside of the channel, if it is bigger then the
+// threshold and the channel matches one of the patterns. It returns the content
+// that has to be saved in the channel.
+func (r *ChannelLayer) offload(conn redis.Conn, channel string, content []byte) ([]byte, error) {
+	o := r.offloader
+	if o == nil || len(content) <= o.threshold || !o.matches(channel) {
+		return content, nil
+	}
+
+	name := uuid.NewV4().String()
+	if o.dir == "" {
+		_, err := conn.Do("SET", r.prefix+"offload:"+name, content, "EX", r.expiry)
+		if err != nil {
+			return nil, fmt.Errorf("redis error: %s", err)
+		}
+	} else {
+		o.cleanup(time.Duration(r.expiry) * time.Second)
+		if err := ioutil.WriteFile(filepath.Join(o.dir, name), content, 0600); err != nil {
+			return nil, fmt.Errorf("can not offload message: %s", err)
+		}
+	}
+	return append(append([]byte{}, offloadMarker...), name...), nil
+}
+
+// load returns the offloaded message, if content is a reference. It removes the
+// offloaded message.
+func (r *ChannelLayer) load(conn redis.Conn, content []byte) ([]byte, error) {
+	if !bytes.HasPrefix(content, offloadMarker) {
+		return content, nil
+	}
+	if r.offloader == nil {
+		return nil, fmt.Errorf("received an offloaded message, but offloading is not configured")
+	}
+
+	name := string(content[len(offloadMarker):])
+	if strings.ContainsAny(name, `/\.`) {
+		return nil, fmt.Errorf("invalid reference to an offloaded message: %s", name)
+	}
+
+	if r.offloader.dir == "" {
+		key := r.prefix + "offload:" + name
+		content, err := redis.Bytes(conn.Do("GET", key))
+		if err == redis.ErrNil {
+			return nil, fmt.Errorf("offloaded message %s is expired", name)
+		} else if err != nil {
+			return nil, fmt.Errorf("redis error: %s", err)
+		}
+		if _, err := conn.Do("DEL", key); err != nil {
+			return nil, fmt.Errorf("redis error: %s", err)
+		}
+		return content, nil
+	}
+
+	path := filepath.Join(r.offloader.dir, name)
+	content, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("can not load offloaded message: %s", err)
+	}
+	return content, os.Remove(path)
+}
+
+// matches returns true, if messages to the channel can be offloaded.
+func (o *offloader) matches(channel string) bool {
+	for _, pattern := range o.patterns {
+		// The pattern was checked in SetOffloading, so there is no error.
+		if ok, _ := path.Match(pattern, channel); ok {
+			return true
+		}
+	}
+	return false
+}
+
+// discard removes an offloaded message, if content is a reference. It is used,
+// when the reference could not be sent to the channel.
+func (r *ChannelLayer) discard(conn redis.Conn, content []byte) {
+	if r.offloader == nil || !bytes.HasPrefix(content, offloadMarker) {
+		return
+	}
+	name := string(content[len(offloadMarker):])
+	if r.offloader.dir == "" {
+		conn.Do("DEL", r.prefix+"offload:"+name)
+		return
+	}
+	os.Remove(filepath.Join(r.offloader.dir, name))
+}
+
+// cleanup removes the files of messages that are expired. Messages expire in
+// the channel without being received, so their files have to be removed. It
+// looks for old files only once in the expiry time.
+func (o *offloader) cleanup(expiry time.Duration) {
+	o.mu.Lock()
+	if time.Since(o.lastCleanup) < expiry {
+		o.mu.Unlock()
+		return
+	}
+	o.lastCleanup = time.Now()
+	o.mu.Unlock()
+
+	files, err := ioutil.ReadDir(o.dir)
+	if err != nil {
+		return
+	}
+	for _, file := range files {
+		if !file.IsDir() && time.Since(file.ModTime()) > expiry {
+			os.Remove(filepath.Join(o.dir, file.Name()))
+		}
+	}
+}
+
+// flush removes all offloaded files.
+func (o *offloader) flush() error {
+	if o == nil || o.dir == "" {
+		return nil
+	}
+	files, err := ioutil.ReadDir(o.dir)
+	if err != nil {
+		return fmt.Errorf("can not read the offload directory: %s", err)
+	}
+	for _, file := range files {
+		if !file.IsDir() {
+			os.Remove(filepath.Join(o.dir, file.Name()))
+		}
+	}
+	return nil
+}
@@ -0,0 +1,140 @@
+package redis
+
+import (
+	"bytes"
+	"io/ioutil"
+	"os"
+	"testing"
+
+	"github.com/ostcar/geiss/asgi"
+)
+
+func TestOffloading(t *testing.T) {
+	dir, err := ioutil.TempDir("", "geiss-offload")
+	if err != nil {
+		t.Fatalf("Can not create a temp dir: %s", err)
+	}
+	defer os.RemoveAll(dir)
+
+	for _, dir := range []string{"", dir} {
+		c, err := NewChannelLayer(0, nil, "testoffloading:", 0, 0)
+		if err != nil {
+			t.Fatalf("Can not create the channel layer: %s", err)
+		}
+		defer c.Flush()
+		if err := c.SetOffloading(1024, dir, nil); err != nil {
+			t.Fatalf("Did not expect an error, got %s", err)
+		}
+
+		big := bytes.Repeat([]byte("x"), 4096)
+		if err := c.Send("MyChannel!abc", asgi.Message{"content": big}); err != nil {
+			t.Errorf("Did not expect an error, got %s", err)
+		}
+		if err := c.Send("MyChannel!abc", asgi.Message{"content": []byte("small")}); err != nil {
+			t.Errorf("Did not expect an error, got %s", err)
+		}
+		// Channels, that are not process specific, are not offloaded by default,
+		// because python workers can not read them.
+		if err := c.Send("http.request", asgi.Message{"content": big}); err != nil {
+			t.Errorf("Did not expect an error, got %s", err)
+		}
+
+		// Only the big message to the process specific channel is offloaded.
+		conn := c.pools[0].Get()
+		offloaded, _ := conn.Do("KEYS", c.prefix+"offload:*")
+		conn.Close()
+		files, _ := ioutil.ReadDir(dir)
+		if count := len(offloaded.([]interface{})) + len(files); count != 1 {
+			t.Errorf("Expected one offloaded message with dir \"%s\", got %d", dir, count)
+		}
+
+		_, message, err := c.Receive([]string{"MyChannel!"}, false)
+		if err != nil {
+			t.Errorf("Did not expect an error, got %s", err)
+		}
+		if content, _ := message["content"].([]byte); !bytes.Equal(content, big) {
+			t.Errorf("Expected to receive the big message, got %d bytes", len(content))
+		}
+		_, message, err = c.Receive([]string{"MyChannel!"}, false)
+		if err != nil {
+			t.Errorf("Did not expect an error, got %s", err)
+		}
+		if content, _ := message["content"].([]byte); string(content) != "small" {
+			t.Errorf("Expected to receive the small message, got %v", message)
+		}
+
+		// The offloaded message is removed after it was received.
+		conn = c.pools[0].Get()
+		offloaded, _ = conn.Do("KEYS", c.prefix+"offload:*")
+		conn.Close()
+		files, _ = ioutil.ReadDir(dir)
+		if count := len(offloaded.([]interface{})) + len(files); count != 0 {
+			t.Errorf("Expected the offloaded message to be removed with dir \"%s\"", dir)
+		}
+	}
+}
+
+func TestOffloadingChannelFull(t *testing.T) {
+	dir, err := ioutil.TempDir("", "geiss-offload")
+	if err != nil {
+		t.Fatalf("Can not create a temp dir: %s", err)
+	}
+	defer os.RemoveAll(dir)
+
+	for _, dir := range []string{"", dir} {
+		c, err := NewChannelLayer(0, nil, "testoffloadingfull:", 1, 0)
+		if err != nil {
+			t.Fatalf("Can not create the channel layer: %s", err)
+		}
+		// Remove the message of the last run, so the channel has space for one
+		// message.
+		c.Flush()
+		defer c.Flush()
+		if err := c.SetOffloading(1024, dir, nil); err != nil {
+			t.Fatalf("Did not expect an error, got %s", err)
+		}
+
+		big := bytes.Repeat([]byte("x"), 4096)
+		if err := c.Send("MyChannel!abc", asgi.Message{"content": big}); err != nil {
+			t.Errorf("Did not expect an error, got %s", err)
+		}
+		for i := 0; i < 3; i++ {
+			if err := c.Send("MyChannel!abc", asgi.Message{"content": big}); !asgi.IsChannelFullError(err) {
+				t.Errorf("Expected a channel full error, got %v", err)
+			}
+		}
+
+		// Only the message in the channel is offloaded.
+		conn := c.pools[0].Get()
+		offloaded, _ := conn.Do("KEYS", c.prefix+"offload:*")
+		conn.Close()
+		files, _ := ioutil.ReadDir(dir)
+		if count := len(offloaded.([]interface{})) + len(files); count != 1 {
+			t.Errorf("Expected one offloaded message with dir \"%s\", got %d", dir, count)
+		}
+	}
+}
+
+func TestOffloadingPatterns(t *testing.T) {
+	c, err := NewChannelLayer(0, nil, "testoffloadingpatterns:", 0, 0)
+	if err != nil {
+		t.Fatalf("Can not create the channel layer: %s", err)
+	}
+	if err := c.SetOffloading(1024, "", []string{"reports.*"}); err != nil {
+		t.Fatalf("Did not expect an error, got %s", err)
+	}
+	for channel, expected := range map[string]bool{
+		"reports.export": true,
+		"reports":        false,
+		"http.request":   false,
+		"foo!bar":        false,
+	} {
+		if got := c.offloader.matches(channel); got != expected {
+			t.Errorf("Expected %t for %s, got %t", expected, channel, got)
+		}
+	}
+
+	if err := c.SetOffloading(1024, "", []string{"[invalid"}); err == nil {
+		t.Errorf("Expected an error for an invalid pattern")
+	}
+}
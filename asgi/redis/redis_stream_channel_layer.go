@@ -0,0 +1,411 @@
+package redis
+
+import (
+	"fmt"
+	"math/rand"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/ostcar/geiss/asgi"
+
+	"github.com/garyburd/redigo/redis"
+)
+
+// Name of the consumer group that is used for all streams.
+const streamGroup = "asgi"
+
+var luaStreamSend, luaStreamPrepare *redis.Script
+
+func init() {
+	// luaStreamSend adds a message to the stream in KEYS[1]. It creates the
+	// consumer group, if it does not exist, and removes all messages that are
+	// older then ARGV[4].
+	luaStreamSend = redis.NewScript(
+		1,
+		`
+		redis.pcall('xgroup', 'create', KEYS[1], 'asgi', '0', 'MKSTREAM')
+		redis.call('xtrim', KEYS[1], 'MINID', ARGV[4])
+		if redis.call('xlen', KEYS[1]) >= tonumber(ARGV[3]) then
+		    return redis.error_reply("full")
+		end
+		redis.call('xadd', KEYS[1], '*', 'message', ARGV[1])
+		redis.call('expire', KEYS[1], ARGV[2] + 1)
+	`)
+
+	// luaStreamPrepare creates all streams in KEYS, that do not exist, so
+	// XREADGROUP can be called on them.
+	luaStreamPrepare = redis.NewScript(
+		-1,
+		`
+		for _, key in ipairs(KEYS) do
+		    if redis.call('exists', key) == 0 then
+		        redis.call('xgroup', 'create', key, 'asgi', '0', 'MKSTREAM')
+		        redis.call('expire', key, ARGV[1] + 1)
+		    end
+		end
+	`)
+}
+
+// StreamMessage is a message that was received from a StreamChannelLayer. It
+// has to be acknowledged with StreamChannelLayer.Ack. Otherwise it stays
+// pending and can be claimed by another consumer.
+type StreamMessage struct {
+	// Channel is the channel name from which the message was received.
+	Channel string
+
+	// ID is the id of the message in the redis stream.
+	ID string
+
+	// Message is the received raw message.
+	Message asgi.Message
+
+	// stream is the channel name of the redis stream. It is different to
+	// Channel for process specific channels.
+	stream string
+}
+
+// PendingMessage is a message that was received but not acknowledged.
+type PendingMessage struct {
+	ID         string
+	Consumer   string
+	Idle       time.Duration
+	Deliveries int64
+}
+
+// StreamChannelLayer is an asgi channel layer that uses redis streams with
+// consumer groups. Each channel is a stream.
+//
+// The methods of the asgi.ChannelLayer interface acknowledge each message as
+// soon as it is received. Use ReceiveMessage and Ack for at-least-once
+// delivery.
+//
+// It needs at least redis 6.2.
+type StreamChannelLayer struct {
+	hostRing
+	prefix   string
+	expiry   int
+	capacity int
+	consumer string
+}
+
+// NewStreamChannelLayer creates a new StreamChannelLayer. If more then one host
+// is given, then the channels are sharded across the hosts. It returns an
+// error, if one of the hosts is invalid.
+func NewStreamChannelLayer(expiry int, hosts []string, prefix string, capacity int) (*StreamChannelLayer, error) {
+	if expiry == 0 {
+		expiry = 60
+	}
+	if prefix == "" {
+		prefix = "asgistream:"
+	}
+	if capacity == 0 {
+		capacity = 100
+	}
+	ring, err := newHostRing(hosts)
+	if err != nil {
+		return nil, err
+	}
+	return &StreamChannelLayer{
+		hostRing: ring,
+		prefix:   prefix,
+		expiry:   expiry,
+		capacity: capacity,
+		consumer: "geiss." + asgi.GetChannelnameRandom(),
+	}, nil
+}
+
+// Flush removes all streams and consumer groups of the channel layer from all
+// hosts.
+func (s *StreamChannelLayer) Flush() error {
+	return s.flushKeys(s.prefix)
+}
+
+// NewChannel creates a new channelname
+func (s *StreamChannelLayer) NewChannel(channelPrefix string) (channel string, err error) {
+	var exists int64
+	conn := s.pools[s.shard(channelPrefix)].Get()
+	defer conn.Close()
+
+	for {
+		// Create a channel name
+		channel = channelPrefix + asgi.GetChannelnameRandom()
+
+		// Test if this channel name already exists.
+		exists, err = redis.Int64(conn.Do("EXISTS", s.prefix+channel))
+		if err != nil {
+			err = fmt.Errorf("redis error: %s", err)
+			return "", err
+		}
+
+		if exists == 0 {
+			// If the key does not exist, then we exit this function
+			// returning the (free) channelname
+			return channel, nil
+		}
+	}
+}
+
+// Send sends a message to a specific channel
+func (s *StreamChannelLayer) Send(channel string, message asgi.Message) (err error) {
+	conn := s.pools[s.shard(channel)].Get()
+	defer conn.Close()
+
+	// Messages to process specific channels are send to the non local channel.
+	name, message := asgi.ProcessLocal(channel, message)
+
+	// Encodes the message with the codec.
+	bytes, err := s.encodeMessage(message)
+	if err != nil {
+		return err
+	}
+
+	// The ids of the stream entries are the time in milliseconds, when they were
+	// added. All older entries then minID are expired.
+	minID := time.Now().Add(-time.Duration(s.expiry)*time.Second).UnixNano() / int64(time.Millisecond)
+	_, err = luaStreamSend.Do(conn, s.prefix+name, bytes, s.expiry, s.capacity, minID)
+	if err != nil {
+		if err.Error() == "full" {
+			return asgi.ChannelFullError{
+				Channel: channel,
+			}
+		}
+		return fmt.Errorf("redis luaStreamSend error: %s", err)
+	}
+	return nil
+}
+
+// Receive reads from a channel and returns a raw message objekt. The message
+// is acknowledged at once.
+func (s *StreamChannelLayer) Receive(
+	channels []string,
+	block bool) (channel string, message asgi.Message, err error) {
+
+	m, err := s.ReceiveMessage(channels, block)
+	if err != nil || m == nil {
+		return "", nil, err
+	}
+	if err = s.Ack(m); err != nil {
+		return "", nil, err
+	}
+	return m.Channel, m.Message, nil
+}
+
+// ReceiveMessage reads from a channel without acknowledging the message. It
+// returns nil, if there is no message.
+func (s *StreamChannelLayer) ReceiveMessage(channels []string, block bool) (m *StreamMessage, err error) {
+	err = s.receive(channels, block, func(index int, channels []string, block bool) (bool, error) {
+		m, err = s.receiveShard(index, channels, block)
+		return m != nil, err
+	})
+	if err != nil {
+		return nil, err
+	}
+	return m, nil
+}
+
+// receiveShard reads from channels that are on the same host.
+func (s *StreamChannelLayer) receiveShard(index int, channels []string, block bool) (*StreamMessage, error) {
+	conn := s.pools[index].Get()
+	defer conn.Close()
+
+	// Shuffle the channels, so the first channels do not starve the others.
+	keys := make([]interface{}, len(channels))
+	for i, j := range rand.Perm(len(channels)) {
+		keys[i] = s.prefix + channels[j]
+	}
+
+	prepareArgs := append([]interface{}{len(keys)}, keys...)
+	if _, err := luaStreamPrepare.Do(conn, append(prepareArgs, s.expiry)...); err != nil {
+		return nil, fmt.Errorf("redis luaStreamPrepare error: %s", err)
+	}
+
+	args := []interface{}{"GROUP", streamGroup, s.consumer, "COUNT", 1}
+	if block {
+		args = append(args, "BLOCK", blPopTimeout*1000)
+	}
+	args = append(args, "STREAMS")
+	args = append(args, keys...)
+	for range keys {
+		args = append(args, ">")
+	}
+
+	for {
+		reply, err := redis.Values(conn.Do("XREADGROUP", args...))
+		if err == redis.ErrNil {
+			// Nothing to receive or got timeout
+			return nil, nil
+		} else if err != nil {
+			if strings.HasPrefix(err.Error(), "NOGROUP") {
+				// The stream expired since it was prepared.
+				return nil, nil
+			}
+			return nil, fmt.Errorf("redis error: %s", err)
+		}
+
+		// There is only one stream in the reply with one entry.
+		stream, err := redis.Values(reply[0], nil)
+		if err != nil {
+			return nil, fmt.Errorf("redis error: %s", err)
+		}
+		key, err := redis.String(stream[0], nil)
+		if err != nil {
+			return nil, fmt.Errorf("redis error: %s", err)
+		}
+		entries, err := redis.Values(stream[1], nil)
+		if err != nil {
+			return nil, fmt.Errorf("redis error: %s", err)
+		}
+
+		m, err := s.parseEntry(strings.TrimPrefix(key, s.prefix), entries[0])
+		if err != nil {
+			return nil, err
+		}
+		if m != nil {
+			return m, nil
+		}
+		// The message was expired. Try the next one.
+	}
+}
+
+// parseEntry creates a StreamMessage from a stream entry. It returns nil, if
+// the message is expired or was deleted. In this case, the message is
+// acknowledged.
+func (s *StreamChannelLayer) parseEntry(stream string, entry interface{}) (*StreamMessage, error) {
+	values, err := redis.Values(entry, nil)
+	if err != nil {
+		return nil, fmt.Errorf("redis error: %s", err)
+	}
+	id, err := redis.String(values[0], nil)
+	if err != nil {
+		return nil, fmt.Errorf("redis error: %s", err)
+	}
+	m := &StreamMessage{Channel: stream, ID: id, stream: stream}
+
+	// The fields of a deleted entry are nil.
+	fields, err := redis.ByteSlices(values[1], nil)
+	if err != nil && err != redis.ErrNil {
+		return nil, fmt.Errorf("redis error: %s", err)
+	}
+	var content []byte
+	for i := 0; i+1 < len(fields); i += 2 {
+		if string(fields[i]) == "message" {
+			content = fields[i+1]
+		}
+	}
+
+	if content == nil || s.expired(id) {
+		return nil, s.Ack(m)
+	}
+
+	m.Channel, m.Message, err = s.decodeMessage(stream, content)
+	if err != nil {
+		return nil, err
+	}
+	return m, nil
+}
+
+// expired returns true, if the stream id is older then the expiry.
+func (s *StreamChannelLayer) expired(id string) bool {
+	ms, err := strconv.ParseInt(strings.SplitN(id, "-", 2)[0], 10, 64)
+	if err != nil {
+		return false
+	}
+	added := time.Unix(0, ms*int64(time.Millisecond))
+	return time.Since(added) > time.Duration(s.expiry)*time.Second
+}
+
+// Ack acknowledges a message and removes it from the stream.
+func (s *StreamChannelLayer) Ack(m *StreamMessage) (err error) {
+	conn := s.pools[s.shard(m.stream)].Get()
+	defer conn.Close()
+
+	key := s.prefix + m.stream
+	conn.Send("MULTI")
+	conn.Send("XACK", key, streamGroup, m.ID)
+	conn.Send("XDEL", key, m.ID)
+	if _, err = conn.Do("EXEC"); err != nil {
+		return fmt.Errorf("redis error: %s", err)
+	}
+	return nil
+}
+
+// Pending returns up to count messages of a channel, that were received but
+// not acknowledged. For a process specific channel like "foo!bar", the messages
+// of all channels with the non local name "foo!" are returned.
+func (s *StreamChannelLayer) Pending(channel string, count int) (pending []PendingMessage, err error) {
+	conn := s.pools[s.shard(channel)].Get()
+	defer conn.Close()
+
+	// Messages to process specific channels are in the non local channel.
+	name, _ := asgi.ProcessLocal(channel, nil)
+	reply, err := redis.Values(conn.Do("XPENDING", s.prefix+name, streamGroup, "-", "+", count))
+	if err == redis.ErrNil {
+		return nil, nil
+	} else if err != nil {
+		if strings.HasPrefix(err.Error(), "NOGROUP") {
+			// The channel does not exist.
+			return nil, nil
+		}
+		return nil, fmt.Errorf("redis error: %s", err)
+	}
+
+	for _, v := range reply {
+		var pm PendingMessage
+		var idle int64
+		values, err := redis.Values(v, nil)
+		if err == nil {
+			_, err = redis.Scan(values, &pm.ID, &pm.Consumer, &idle, &pm.Deliveries)
+		}
+		if err != nil {
+			return nil, fmt.Errorf("redis error: %s", err)
+		}
+		pm.Idle = time.Duration(idle) * time.Millisecond
+		pending = append(pending, pm)
+	}
+	return pending, nil
+}
+
+// Claim takes up to count messages of a channel, that are pending for at least
+// minIdle, from other consumers. They have to be acknowledged like messages
+// from ReceiveMessage. Like Pending, it uses the non local name of a process
+// specific channel.
+func (s *StreamChannelLayer) Claim(channel string, minIdle time.Duration, count int) (messages []*StreamMessage, err error) {
+	conn := s.pools[s.shard(channel)].Get()
+	defer conn.Close()
+
+	// Messages to process specific channels are in the non local channel.
+	name, _ := asgi.ProcessLocal(channel, nil)
+	reply, err := redis.Values(conn.Do(
+		"XAUTOCLAIM",
+		s.prefix+name,
+		streamGroup,
+		s.consumer,
+		int64(minIdle/time.Millisecond),
+		"0",
+		"COUNT",
+		count,
+	))
+	if err != nil {
+		if strings.HasPrefix(err.Error(), "NOGROUP") {
+			// The channel does not exist.
+			return nil, nil
+		}
+		return nil, fmt.Errorf("redis error: %s", err)
+	}
+
+	entries, err := redis.Values(reply[1], nil)
+	if err != nil {
+		return nil, fmt.Errorf("redis error: %s", err)
+	}
+	for _, entry := range entries {
+		m, err := s.parseEntry(name, entry)
+		if err != nil {
+			return nil, err
+		}
+		if m != nil {
+			messages = append(messages, m)
+		}
+	}
+	return messages, nil
+}
@@ -4,13 +4,19 @@ import (
 	"fmt"
 	"strings"
 	"testing"
+	"time"
 
 	"github.com/ostcar/geiss/asgi"
+	"github.com/ostcar/geiss/asgi/layertest"
+
+	"github.com/garyburd/redigo/redis"
 )
 
 func TestNewChannel(t *testing.T) {
-	redisPool = nil
-	c := NewChannelLayer(0, "", "test:", 0)
+	c, err := NewChannelLayer(0, nil, "test:", 0, 0)
+	if err != nil {
+		t.Fatalf("Can not create the channel layer: %s", err)
+	}
 
 	channel, err := c.NewChannel("myprefix!")
 	if err != nil {
@@ -21,6 +27,39 @@ func TestNewChannel(t *testing.T) {
 	}
 }
 
+func TestConsistentHash(t *testing.T) {
+	c, err := NewChannelLayer(0, []string{":6379", ":6380", ":6381"}, "test:", 0, 0)
+	if err != nil {
+		t.Fatalf("Can not create the channel layer: %s", err)
+	}
+
+	for _, channel := range []string{"http.request", "websocket.connect", "foo!bar", ""} {
+		index := c.consistentHash(channel)
+		if index < 0 || index >= 3 {
+			t.Errorf("Expected the index for %s to be between 0 and 2, got %d", channel, index)
+		}
+		if index != c.consistentHash(channel) {
+			t.Errorf("Expected the index for %s to be the same every time", channel)
+		}
+	}
+
+	// All process specific channels of one process are on the same host.
+	index := c.shard("geiss.response.abc!")
+	for _, channel := range []string{"geiss.response.abc!foo", "geiss.response.abc!bar"} {
+		if c.shard(channel) != index {
+			t.Errorf("Expected the channel %s to be on host %d, got %d", channel, index, c.shard(channel))
+		}
+	}
+
+	c, err = NewChannelLayer(0, nil, "test:", 0, 0)
+	if err != nil {
+		t.Fatalf("Can not create the channel layer: %s", err)
+	}
+	if c.consistentHash("http.request") != 0 {
+		t.Errorf("Expected all channels to be on the first host, if there is only one")
+	}
+}
+
 type testMessage struct {
 	s string
 }
@@ -42,12 +81,15 @@ func (t *testMessage) Set(m asgi.Message) error {
 
 func TestSendAndReceive(t *testing.T) {
 	innerTest := func(block bool) {
-		redisPool = nil
-		c := NewChannelLayer(0, "", "testsendandreceive:", 0)
+		c, err := NewChannelLayer(0, nil, "testsendandreceive:", 0, 0)
+		if err != nil {
+			t.Fatalf("Can not create the channel layer: %s", err)
+		}
+		defer c.Flush()
 		sendMessage := testMessage{
 			s: "MyMessage",
 		}
-		err := c.Send("MyChannel", sendMessage.Raw())
+		err = c.Send("MyChannel", sendMessage.Raw())
 		if err != nil {
 			t.Errorf("Did not expect any error, got %s", err)
 		}
@@ -75,8 +117,11 @@ func TestSendAndReceive(t *testing.T) {
 }
 
 func TestSendChannelFull(t *testing.T) {
-	redisPool = nil
-	c := NewChannelLayer(0, "", "testsendchannelfull:", 1)
+	c, err := NewChannelLayer(0, nil, "testsendchannelfull:", 1, 0)
+	if err != nil {
+		t.Fatalf("Can not create the channel layer: %s", err)
+	}
+	defer c.Flush()
 	sendMessage := testMessage{
 		s: "MyMessage",
 	}
@@ -93,3 +138,248 @@ func TestSendChannelFull(t *testing.T) {
 		t.Errorf("Expected a channel full error, got %s", err)
 	}
 }
+
+func TestGroups(t *testing.T) {
+	c, err := NewChannelLayer(0, nil, "testgroups:", 0, 0)
+	if err != nil {
+		t.Fatalf("Can not create the channel layer: %s", err)
+	}
+	defer c.Flush()
+	sendMessage := testMessage{
+		s: "MyMessage",
+	}
+
+	for _, channel := range []string{"channel1", "channel2"} {
+		if err := c.GroupAdd("MyGroup", channel); err != nil {
+			t.Errorf("Did not expect an error, got %s", err)
+		}
+	}
+	if err := c.SendGroup("MyGroup", sendMessage.Raw()); err != nil {
+		t.Errorf("Did not expect an error, got %s", err)
+	}
+	for _, channel := range []string{"channel1", "channel2"} {
+		received, _, err := c.Receive([]string{channel}, false)
+		if err != nil {
+			t.Errorf("Did not expect an error, got %s", err)
+		}
+		if received != channel {
+			t.Errorf("Expected a message on %s, got one on \"%s\"", channel, received)
+		}
+	}
+
+	if err := c.GroupDiscard("MyGroup", "channel1"); err != nil {
+		t.Errorf("Did not expect an error, got %s", err)
+	}
+	if err := c.SendGroup("MyGroup", sendMessage.Raw()); err != nil {
+		t.Errorf("Did not expect an error, got %s", err)
+	}
+	received, _, err := c.Receive([]string{"channel1", "channel2"}, false)
+	if err != nil {
+		t.Errorf("Did not expect an error, got %s", err)
+	}
+	if received != "channel2" {
+		t.Errorf("Expected a message on channel2, got one on \"%s\"", received)
+	}
+	received, _, err = c.Receive([]string{"channel1", "channel2"}, false)
+	if err != nil {
+		t.Errorf("Did not expect an error, got %s", err)
+	}
+	if received != "" {
+		t.Errorf("Expected no message, got one on \"%s\"", received)
+	}
+}
+
+func TestStatisticsAndFlush(t *testing.T) {
+	c, err := NewChannelLayer(0, nil, "teststatistics:", 2, 0)
+	if err != nil {
+		t.Fatalf("Can not create the channel layer: %s", err)
+	}
+	defer c.Flush()
+	sendMessage := testMessage{
+		s: "MyMessage",
+	}
+
+	for i := 0; i < 3; i++ {
+		// The third message does not fit into the channel.
+		c.Send("MyChannel", sendMessage.Raw())
+	}
+	c.Send("OtherChannel", sendMessage.Raw())
+	c.Send("Local!abc", sendMessage.Raw())
+
+	stats, err := c.ChannelStatistics("MyChannel")
+	if err != nil {
+		t.Errorf("Did not expect an error, got %s", err)
+	}
+	if stats.MessagesCount != 2 || stats.MessagesPending != 2 || stats.ChannelFullCount != 1 {
+		t.Errorf("Got wrong statistics for MyChannel: %+v", stats)
+	}
+
+	// The messages of a process specific channel are queued in the non local
+	// channel.
+	stats, err = c.ChannelStatistics("Local!abc")
+	if err != nil {
+		t.Errorf("Did not expect an error, got %s", err)
+	}
+	if stats.MessagesCount != 1 || stats.MessagesPending != 1 {
+		t.Errorf("Got wrong statistics for Local!abc: %+v", stats)
+	}
+
+	stats, err = c.GlobalStatistics()
+	if err != nil {
+		t.Errorf("Did not expect an error, got %s", err)
+	}
+	if stats.MessagesCount != 4 || stats.MessagesPending != 4 || stats.ChannelFullCount != 1 {
+		t.Errorf("Got wrong global statistics: %+v", stats)
+	}
+
+	if err = c.Flush(); err != nil {
+		t.Errorf("Did not expect an error, got %s", err)
+	}
+	stats, err = c.GlobalStatistics()
+	if err != nil {
+		t.Errorf("Did not expect an error, got %s", err)
+	}
+	if stats != (asgi.Statistics{}) {
+		t.Errorf("Expected all statistics to be empty after a flush, got %+v", stats)
+	}
+}
+
+func TestReceiveDeletesMessage(t *testing.T) {
+	innerTest := func(block bool) {
+		c, err := NewChannelLayer(0, nil, "testreceivedeletesmessage:", 0, 0)
+		if err != nil {
+			t.Fatalf("Can not create the channel layer: %s", err)
+		}
+		defer c.Flush()
+		sendMessage := testMessage{
+			s: "MyMessage",
+		}
+		if err := c.Send("MyChannel", sendMessage.Raw()); err != nil {
+			t.Errorf("Did not expect an error, got %s", err)
+		}
+
+		channel, _, err := c.Receive([]string{"OtherChannel", "MyChannel"}, block)
+		if err != nil {
+			t.Errorf("Did not expect an error, got %s", err)
+		}
+		if channel != "MyChannel" {
+			t.Errorf("Did expect the channel name MyChannel, got \"%s\"", channel)
+		}
+
+		// Only the statistics should be left in redis.
+		conn := c.pools[0].Get()
+		defer conn.Close()
+		err = scanKeys(conn, c.prefix, func(keys []string) error {
+			for _, key := range keys {
+				if !strings.HasPrefix(key, c.prefix+"stats:") {
+					t.Errorf("Did not expect the key %s to exist after receiving the message", key)
+				}
+			}
+			return nil
+		})
+		if err != nil {
+			t.Errorf("Did not expect an error, got %s", err)
+		}
+	}
+	innerTest(true)
+	innerTest(false)
+}
+
+func TestSymmetricEncryption(t *testing.T) {
+	c, err := NewChannelLayer(0, nil, "testsymmetricencryption:", 0, 0)
+	if err != nil {
+		t.Fatalf("Can not create the channel layer: %s", err)
+	}
+	defer c.Flush()
+	c.SetSymmetricEncryptionKeys([]string{"old key"})
+	if err := c.Send("MyChannel", asgi.Message{"message": "secret text"}); err != nil {
+		t.Errorf("Did not expect an error, got %s", err)
+	}
+
+	// The message is not saved as plain text.
+	conn := c.pools[0].Get()
+	defer conn.Close()
+	err = scanKeys(conn, c.prefix, func(keys []string) error {
+		for _, key := range keys {
+			content, _ := redis.Bytes(conn.Do("GET", key))
+			if strings.Contains(string(content), "secret text") {
+				t.Errorf("Expected the message in %s to be encrypted", key)
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		t.Errorf("Did not expect an error, got %s", err)
+	}
+
+	// After a key rotation, the message can still be received.
+	c.SetSymmetricEncryptionKeys([]string{"new key", "old key"})
+	_, message, err := c.Receive([]string{"MyChannel"}, false)
+	if err != nil {
+		t.Errorf("Did not expect an error, got %s", err)
+	}
+	if message["message"] != "secret text" {
+		t.Errorf("Expected the message \"secret text\", got %v", message)
+	}
+}
+
+func TestConformance(t *testing.T) {
+	layertest.RunConformance(t, func(expiry, capacity int) asgi.ChannelLayer {
+		c, err := NewChannelLayer(expiry, nil, "testconformance:", capacity, 0)
+		if err != nil {
+			t.Fatalf("Can not create the channel layer: %s", err)
+		}
+		return c
+	})
+}
+
+func TestReceiveShards(t *testing.T) {
+	// Two databases of the same server are used as two hosts.
+	c, err := NewChannelLayer(0, []string{"redis://localhost:6379/0", "redis://localhost:6379/1"}, "testreceiveshards:", 0, 0)
+	if err != nil {
+		t.Fatalf("Can not create the channel layer: %s", err)
+	}
+	defer c.Flush()
+
+	// Find two channels on different hosts.
+	channels := []string{"shard0"}
+	for i := 1; len(channels) < 2; i++ {
+		channel := fmt.Sprintf("shard%d", i)
+		if c.shard(channel) != c.shard(channels[0]) {
+			channels = append(channels, channel)
+		}
+	}
+
+	for _, channel := range channels {
+		received := make(chan string)
+		go func() {
+			name, _, err := c.Receive(channels, true)
+			if err != nil {
+				t.Errorf("Did not expect an error, got %s", err)
+			}
+			received <- name
+		}()
+
+		// Send the message, after the receiver started to wait.
+		time.Sleep(100 * time.Millisecond)
+		start := time.Now()
+		if err := c.Send(channel, asgi.Message{"message": "hello"}); err != nil {
+			t.Fatalf("Did not expect an error, got %s", err)
+		}
+		if name := <-received; name != channel {
+			t.Errorf("Expected a message on %s, got one on \"%s\"", channel, name)
+		}
+		if d := time.Since(start); d > time.Second {
+			t.Errorf("Expected to receive the message on %s at once, took %s", channel, d)
+		}
+	}
+}
+
+func TestNewChannelLayerInvalidHost(t *testing.T) {
+	if _, err := NewChannelLayer(0, []string{"http://localhost"}, "test:", 0, 0); err == nil {
+		t.Errorf("Expected an error for an invalid host")
+	}
+	if _, err := NewStreamChannelLayer(0, []string{"redis://localhost/one"}, "test:", 0); err == nil {
+		t.Errorf("Expected an error for an invalid host")
+	}
+}
@@ -0,0 +1,217 @@
+package redis
+
+import (
+	"testing"
+	"time"
+
+	"github.com/ostcar/geiss/asgi"
+	"github.com/ostcar/geiss/asgi/layertest"
+)
+
+func TestStreamSendAndReceive(t *testing.T) {
+	innerTest := func(block bool) {
+		c, err := NewStreamChannelLayer(0, nil, "teststreamsendandreceive:", 0)
+		if err != nil {
+			t.Fatalf("Can not create the channel layer: %s", err)
+		}
+		defer c.Flush()
+		sendMessage := testMessage{
+			s: "MyMessage",
+		}
+		err = c.Send("MyChannel", sendMessage.Raw())
+		if err != nil {
+			t.Errorf("Did not expect any error, got %s", err)
+		}
+
+		channel, message, err := c.Receive([]string{"OtherChannel", "MyChannel"}, block)
+		if err != nil {
+			t.Errorf("Did not expect any error, got %s", err)
+		}
+
+		var receiveMessage testMessage
+		err = receiveMessage.Set(message)
+		if err != nil {
+			t.Errorf("Did not expect any error, got %s", err)
+		}
+
+		if channel != "MyChannel" {
+			t.Errorf("Did expect the channel name MyChannel, got \"%s\"", channel)
+		}
+		if receiveMessage != sendMessage {
+			t.Errorf("Expect the send message to be the received message")
+		}
+
+		channel, _, err = c.Receive([]string{"MyChannel"}, false)
+		if err != nil {
+			t.Errorf("Did not expect any error, got %s", err)
+		}
+		if channel != "" {
+			t.Errorf("Did expect no message, got one on \"%s\"", channel)
+		}
+	}
+	innerTest(true)
+	innerTest(false)
+}
+
+func TestStreamSendChannelFull(t *testing.T) {
+	c, err := NewStreamChannelLayer(0, nil, "teststreamsendchannelfull:", 1)
+	if err != nil {
+		t.Fatalf("Can not create the channel layer: %s", err)
+	}
+	defer c.Flush()
+	sendMessage := testMessage{
+		s: "MyMessage",
+	}
+	channelname, err := c.NewChannel("TestStreamSendChannelFull")
+	if err != nil {
+		t.Errorf("Did not expect an error, got %s", err)
+	}
+	err = c.Send(channelname, sendMessage.Raw())
+	if err != nil {
+		t.Errorf("Did not expect an error, got %s", err)
+	}
+	err = c.Send(channelname, sendMessage.Raw())
+	if !asgi.IsChannelFullError(err) {
+		t.Errorf("Expected a channel full error, got %s", err)
+	}
+}
+
+func TestStreamPendingAndClaim(t *testing.T) {
+	c, err := NewStreamChannelLayer(0, nil, "teststreampending:", 0)
+	if err != nil {
+		t.Fatalf("Can not create the channel layer: %s", err)
+	}
+	defer c.Flush()
+	sendMessage := testMessage{
+		s: "MyMessage",
+	}
+	channelname, err := c.NewChannel("TestStreamPendingAndClaim")
+	if err != nil {
+		t.Errorf("Did not expect an error, got %s", err)
+	}
+	if err = c.Send(channelname, sendMessage.Raw()); err != nil {
+		t.Errorf("Did not expect an error, got %s", err)
+	}
+
+	m, err := c.ReceiveMessage([]string{channelname}, false)
+	if err != nil {
+		t.Errorf("Did not expect an error, got %s", err)
+	}
+	if m == nil {
+		t.Fatalf("Expected a message on %s", channelname)
+	}
+
+	pending, err := c.Pending(channelname, 10)
+	if err != nil {
+		t.Errorf("Did not expect an error, got %s", err)
+	}
+	if len(pending) != 1 || pending[0].ID != m.ID || pending[0].Consumer != c.consumer {
+		t.Errorf("Expected the received message to be pending, got %+v", pending)
+	}
+
+	// Another consumer claims the message, that was not acknowledged.
+	other, err := NewStreamChannelLayer(0, nil, "teststreampending:", 0)
+	if err != nil {
+		t.Fatalf("Can not create the channel layer: %s", err)
+	}
+	time.Sleep(10 * time.Millisecond)
+	claimed, err := other.Claim(channelname, 5*time.Millisecond, 10)
+	if err != nil {
+		t.Errorf("Did not expect an error, got %s", err)
+	}
+	if len(claimed) != 1 || claimed[0].ID != m.ID {
+		t.Fatalf("Expected to claim the pending message, got %v", claimed)
+	}
+
+	if err = other.Ack(claimed[0]); err != nil {
+		t.Errorf("Did not expect an error, got %s", err)
+	}
+	pending, err = c.Pending(channelname, 10)
+	if err != nil {
+		t.Errorf("Did not expect an error, got %s", err)
+	}
+	if len(pending) != 0 {
+		t.Errorf("Expected no pending messages after the ack, got %+v", pending)
+	}
+}
+
+func TestStreamPendingAndClaimProcessLocal(t *testing.T) {
+	c, err := NewStreamChannelLayer(0, nil, "teststreampendinglocal:", 0)
+	if err != nil {
+		t.Fatalf("Can not create the channel layer: %s", err)
+	}
+	defer c.Flush()
+	sendMessage := testMessage{
+		s: "MyMessage",
+	}
+	channelname := "TestStreamPendingAndClaim!abc"
+	if err = c.Send(channelname, sendMessage.Raw()); err != nil {
+		t.Errorf("Did not expect an error, got %s", err)
+	}
+
+	m, err := c.ReceiveMessage([]string{"TestStreamPendingAndClaim!"}, false)
+	if err != nil {
+		t.Errorf("Did not expect an error, got %s", err)
+	}
+	if m == nil || m.Channel != channelname {
+		t.Fatalf("Expected a message on %s, got %+v", channelname, m)
+	}
+
+	pending, err := c.Pending(channelname, 10)
+	if err != nil {
+		t.Errorf("Did not expect an error, got %s", err)
+	}
+	if len(pending) != 1 || pending[0].ID != m.ID {
+		t.Errorf("Expected the received message to be pending, got %+v", pending)
+	}
+
+	other, err := NewStreamChannelLayer(0, nil, "teststreampendinglocal:", 0)
+	if err != nil {
+		t.Fatalf("Can not create the channel layer: %s", err)
+	}
+	time.Sleep(10 * time.Millisecond)
+	claimed, err := other.Claim(channelname, 5*time.Millisecond, 10)
+	if err != nil {
+		t.Errorf("Did not expect an error, got %s", err)
+	}
+	if len(claimed) != 1 || claimed[0].ID != m.ID || claimed[0].Channel != channelname {
+		t.Fatalf("Expected to claim the pending message, got %v", claimed)
+	}
+	if err = other.Ack(claimed[0]); err != nil {
+		t.Errorf("Did not expect an error, got %s", err)
+	}
+}
+
+func TestStreamConformance(t *testing.T) {
+	layertest.RunConformance(t, func(expiry, capacity int) asgi.ChannelLayer {
+		c, err := NewStreamChannelLayer(expiry, nil, "teststreamconformance:", capacity)
+		if err != nil {
+			t.Fatalf("Can not create the channel layer: %s", err)
+		}
+		return c
+	})
+}
+
+func TestStreamFlush(t *testing.T) {
+	c, err := NewStreamChannelLayer(0, nil, "teststreamflush:", 0)
+	if err != nil {
+		t.Fatalf("Can not create the channel layer: %s", err)
+	}
+	c.Send("MyChannel", asgi.Message{"message": "hello"})
+	// Receiving creates the consumer group.
+	c.Receive([]string{"OtherChannel"}, false)
+
+	if err := c.Flush(); err != nil {
+		t.Fatalf("Did not expect an error, got %s", err)
+	}
+	conn := c.pools[0].Get()
+	defer conn.Close()
+	var count int
+	scanKeys(conn, c.prefix, func(keys []string) error {
+		count += len(keys)
+		return nil
+	})
+	if count != 0 {
+		t.Errorf("Expected no keys after a flush, got %d", count)
+	}
+}
@@ -1,6 +1,7 @@
 package asgi
 
 import (
+	"encoding/json"
 	"fmt"
 	"math/rand"
 	"net"
@@ -26,6 +27,26 @@ func GetChannelnameRandom() string {
 	return string(b[:])
 }
 
+// ProcessLocal prepares a message to be send to a process specific channel.
+// If channel is a process specific channel like "foo!bar", then it returns the
+// non local part of the name ("foo!") and a copy of the message, that holds the
+// full channel name in the field "__asgi_channel__". Channel layers send the
+// message to the non local channel and use the field on receive. All other
+// channel names and messages are returned unchanged.
+func ProcessLocal(channel string, message Message) (string, Message) {
+	i := strings.Index(channel, "!")
+	if i < 0 || i == len(channel)-1 {
+		return channel, message
+	}
+
+	m := make(Message, len(message)+1)
+	for k, v := range message {
+		m[k] = v
+	}
+	m["__asgi_channel__"] = channel
+	return channel[:i+1], m
+}
+
 // ForwardError is an error that holds another error inside
 type ForwardError struct {
 	err  error
@@ -80,3 +101,190 @@ func ConvertHeader(httpHeaders http.Header) (headers [][2][]byte) {
 	}
 	return
 }
+
+// toInt converts the numeric types that the codecs produce to an int. It
+// returns false, if the value is not a number or has a fraction.
+func toInt(value interface{}) (int, bool) {
+	switch v := value.(type) {
+	case int:
+		return v, true
+	case int8:
+		return int(v), true
+	case int16:
+		return int(v), true
+	case int32:
+		return int(v), true
+	case int64:
+		return int(v), true
+	case uint:
+		return int(v), true
+	case uint8:
+		return int(v), true
+	case uint16:
+		return int(v), true
+	case uint32:
+		return int(v), true
+	case uint64:
+		return int(v), true
+	case float32:
+		return int(v), float32(int(v)) == v
+	case float64:
+		return int(v), float64(int(v)) == v
+	case json.Number:
+		i, err := v.Int64()
+		return int(i), err == nil
+	}
+	return 0, false
+}
+
+// toBytes converts a value to a byte slice. Some codecs can not distinguish
+// between bytes and strings, so both are accepted.
+func toBytes(value interface{}) ([]byte, bool) {
+	switch v := value.(type) {
+	case []byte:
+		return v, true
+	case string:
+		return []byte(v), true
+	}
+	return nil, false
+}
+
+// getString returns the string in the field key of a message. A missing field
+// or nil is returned as empty string.
+func getString(m Message, key string) (string, error) {
+	switch v := m[key].(type) {
+	case string:
+		return v, nil
+	case []byte:
+		return string(v), nil
+	case nil:
+		return "", nil
+	}
+	return "", fmt.Errorf("message has wrong format. \"%s\" has to be a string not %T", key, m[key])
+}
+
+// getBytes returns the bytes in the field key of a message. A missing field or
+// nil is returned as nil.
+func getBytes(m Message, key string) ([]byte, error) {
+	if m[key] == nil {
+		return nil, nil
+	}
+	b, ok := toBytes(m[key])
+	if !ok {
+		return nil, fmt.Errorf("message has wrong format. \"%s\" has to be bytes not %T", key, m[key])
+	}
+	return b, nil
+}
+
+// getInt returns the integer in the field key of a message. A missing field or
+// nil is returned as 0.
+func getInt(m Message, key string) (int, error) {
+	if m[key] == nil {
+		return 0, nil
+	}
+	i, ok := toInt(m[key])
+	if !ok {
+		return 0, fmt.Errorf("message has wrong format. \"%s\" has to be an integer not %T", key, m[key])
+	}
+	return i, nil
+}
+
+// getBool returns the bool in the field key of a message. A missing field or nil
+// is returned as false.
+func getBool(m Message, key string) (bool, error) {
+	switch v := m[key].(type) {
+	case bool:
+		return v, nil
+	case nil:
+		return false, nil
+	}
+	return false, fmt.Errorf("message has wrong format. \"%s\" has to be a bool not %T", key, m[key])
+}
+
+// hostToStr is the opposite of strToHost. It converts a two element list with a
+// host and a port to a string in the form "host:port". nil is converted to an
+// empty string.
+func hostToStr(value interface{}) (string, error) {
+	var hp []interface{}
+	switch v := value.(type) {
+	case nil:
+		return "", nil
+	case [2]interface{}:
+		hp = v[:]
+	case []interface{}:
+		hp = v
+	}
+	if len(hp) != 2 {
+		return "", fmt.Errorf("a host has to be a list with two elements not %v", value)
+	}
+	host, ok := toBytes(hp[0])
+	if !ok {
+		return "", fmt.Errorf("the host has to be a string not %T", hp[0])
+	}
+	port, ok := toInt(hp[1])
+	if !ok {
+		return "", fmt.Errorf("the port has to be an integer not %T", hp[1])
+	}
+	return net.JoinHostPort(string(host), strconv.Itoa(port)), nil
+}
+
+// optionalHost converts a string in the form "host:port" like strToHost. An
+// empty string is converted to nil.
+func optionalHost(hostport string) (interface{}, error) {
+	if hostport == "" {
+		return nil, nil
+	}
+	return strToHost(hostport)
+}
+
+// parseHeader is the opposite of ConvertHeader. It converts a list of header
+// names and values to http.Header.
+func parseHeader(value interface{}) (http.Header, error) {
+	headers := make(http.Header)
+	switch v := value.(type) {
+	case [][2][]byte:
+		for _, header := range v {
+			headers.Add(string(header[0]), string(header[1]))
+		}
+	case []interface{}:
+		for _, header := range v {
+			// header should be a slice of interface{} with two elements
+			header, ok := header.([]interface{})
+			if !ok || len(header) != 2 {
+				return nil, fmt.Errorf("message has wrong format. each header has to be a list with two elements")
+			}
+			k, okKey := toBytes(header[0])
+			v, okValue := toBytes(header[1])
+			if !okKey || !okValue {
+				return nil, fmt.Errorf("message has wrong format. header names and values have to be bytes")
+			}
+			headers.Add(string(k), string(v))
+		}
+	case nil:
+	default:
+		return nil, fmt.Errorf("message has wrong format. \"headers\" has to be a list not %T", value)
+	}
+	return headers, nil
+}
+
+// toMessage converts a dict inside of a message to a Message. The codecs decode
+// dicts to different types.
+func toMessage(value interface{}) (Message, bool) {
+	switch v := value.(type) {
+	case Message:
+		return v, true
+	case map[string]interface{}:
+		return Message(v), true
+	case map[interface{}]interface{}:
+		m := make(Message, len(v))
+		for key, e := range v {
+			k, ok := toBytes(key)
+			if !ok {
+				return nil, false
+			}
+			m[string(k)] = e
+		}
+		return m, true
+	}
+	return nil, false
+}
@@ -15,6 +15,31 @@ func TestGetChannelnameRandom(t *testing.T) {
 	}
 }
 
+func TestProcessLocal(t *testing.T) {
+	message := Message{"text": "foo"}
+
+	channel, m := ProcessLocal("http.request", message)
+	if channel != "http.request" || m["__asgi_channel__"] != nil {
+		t.Errorf("Expected a normal channel to be unchanged, got %s and %v", channel, m)
+	}
+
+	channel, m = ProcessLocal("foo!", message)
+	if channel != "foo!" || m["__asgi_channel__"] != nil {
+		t.Errorf("Expected a non local channel to be unchanged, got %s and %v", channel, m)
+	}
+
+	channel, m = ProcessLocal("foo!bar", message)
+	if channel != "foo!" {
+		t.Errorf("Expected the channel name \"foo!\", got %s", channel)
+	}
+	if m["__asgi_channel__"] != "foo!bar" || m["text"] != "foo" {
+		t.Errorf("Expected the message to have the full channel name, got %v", m)
+	}
+	if _, ok := message["__asgi_channel__"]; ok {
+		t.Errorf("Expected the original message not to be changed")
+	}
+}
+
 func TestForwardError(t *testing.T) {
 	err := fmt.Errorf("I am an error")
 	err = NewForwardError("Error catched", err)
@@ -0,0 +1,260 @@
+package worker
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/ostcar/geiss/asgi"
+)
+
+const (
+	// Time to wait for the next chunk of a request body.
+	bodyChunkWait = 30 * time.Second
+
+	// Maximum size of the content of one response message.
+	responseChunkSize = 500 * 1024
+)
+
+// HTTP returns a HTTPHandler that calls a http.Handler. The request body is read
+// from the body channel, when the handler reads it. The response is send to the
+// reply channel, when the handler returns or when it calls Flush.
+func HTTP(handler http.Handler) HTTPHandler {
+	return httpAdapter{handler: handler}
+}
+
+type httpAdapter struct {
+	handler http.Handler
+}
+
+// ServeASGI calls the http.Handler and sends the response.
+func (a httpAdapter) ServeASGI(layer asgi.ChannelLayer, rm *asgi.RequestMessage) (err error) {
+	req, err := newRequest(layer, rm)
+	if err != nil {
+		return err
+	}
+
+	w := &responseWriter{
+		layer:   layer,
+		channel: rm.ReplyChannel,
+		header:  make(http.Header),
+	}
+
+	defer func() {
+		if r := recover(); r != nil {
+			log.Printf("Error: http handler for %s panicked: %v", rm.Path, r)
+			if !w.headerSent {
+				w.header = make(http.Header)
+				w.status = http.StatusInternalServerError
+				w.buf.Reset()
+				w.buf.WriteString(http.StatusText(http.StatusInternalServerError))
+			}
+		}
+		if sendErr := w.finish(); sendErr != nil && err == nil {
+			err = sendErr
+		}
+	}()
+
+	a.handler.ServeHTTP(w, req)
+	return nil
+}
+
+// newRequest creates a http.Request from a request message.
+func newRequest(layer asgi.ChannelLayer, rm *asgi.RequestMessage) (*http.Request, error) {
+	u := &url.URL{Path: rm.Path, RawQuery: string(rm.QueryString)}
+	var body io.Reader = bytes.NewReader(rm.Body)
+	if rm.BodyChannel != "" {
+		body = io.MultiReader(body, &bodyReader{layer: layer, channel: rm.BodyChannel})
+	}
+
+	req, err := http.NewRequest(rm.Method, u.String(), body)
+	if err != nil {
+		return nil, fmt.Errorf("can not create http request: %s", err)
+	}
+	req.URL.Scheme = rm.Scheme
+	req.Header = rm.Headers
+	req.Host = rm.Headers.Get("Host")
+	req.RemoteAddr = rm.Client
+	if req.Host == "" {
+		req.Host = rm.Server
+	}
+	req.RequestURI = u.RequestURI()
+	if major, minor, ok := http.ParseHTTPVersion(httpProto(rm.HTTPVersion)); ok {
+		req.Proto, req.ProtoMajor, req.ProtoMinor = httpProto(rm.HTTPVersion), major, minor
+	}
+	if rm.BodyChannel == "" {
+		req.ContentLength = int64(len(rm.Body))
+	} else {
+		// The length of the body is not known.
+		req.ContentLength = -1
+	}
+	return req, nil
+}
+
+// httpProto returns the protocol in the form HTTP/1.1. The asgi specs use 1.1
+// but Geiss sends HTTP/1.1.
+func httpProto(version string) string {
+	if strings.HasPrefix(version, "HTTP/") {
+		return version
+	}
+	return "HTTP/" + version
+}
+
+// bodyReader reads the chunks of a request body from the body channel.
+type bodyReader struct {
+	layer   asgi.ChannelLayer
+	channel string
+	buf     []byte
+	eof     bool
+}
+
+func (b *bodyReader) Read(p []byte) (int, error) {
+	deadline := time.Now().Add(bodyChunkWait)
+	for len(b.buf) == 0 {
+		if b.eof {
+			return 0, io.EOF
+		}
+		if time.Now().After(deadline) {
+			return 0, fmt.Errorf("did not receive the next part of the body in time")
+		}
+
+		channel, message, err := b.layer.Receive([]string{b.channel}, true)
+		if err != nil {
+			return 0, err
+		}
+		if channel == "" {
+			continue
+		}
+
+		var chunk asgi.RequestBodyChunkMessage
+		if err := chunk.Set(message); err != nil {
+			return 0, err
+		}
+		if chunk.Closed {
+			return 0, fmt.Errorf("the client closed the connection")
+		}
+		b.buf = chunk.Content
+		b.eof = !chunk.MoreContent
+	}
+	n := copy(p, b.buf)
+	b.buf = b.buf[n:]
+	return n, nil
+}
+
+// responseWriter is a http.ResponseWriter that sends the response to a reply
+// channel.
+type responseWriter struct {
+	layer   asgi.ChannelLayer
+	channel string
+
+	header     http.Header
+	status     int
+	buf        bytes.Buffer
+	headerSent bool
+	err        error
+}
+
+func (w *responseWriter) Header() http.Header {
+	return w.header
+}
+
+func (w *responseWriter) WriteHeader(status int) {
+	if w.status == 0 {
+		w.status = status
+	}
+}
+
+func (w *responseWriter) Write(p []byte) (int, error) {
+	if w.err != nil {
+		return 0, w.err
+	}
+	w.WriteHeader(http.StatusOK)
+	w.buf.Write(p)
+	if w.buf.Len() >= responseChunkSize {
+		w.Flush()
+	}
+	return len(p), w.err
+}
+
+// Flush sends the buffered content to the client.
+func (w *responseWriter) Flush() {
+	if w.err == nil {
+		w.err = w.send(true)
+	}
+}
+
+// Push sends a server push message for the target. Geiss pushes the resource,
+// if the client uses HTTP/2. The response headers are sent before the push
+// message, so they can not be changed afterwards.
+func (w *responseWriter) Push(target string, opts *http.PushOptions) error {
+	u, err := url.Parse(target)
+	if err != nil {
+		return fmt.Errorf("invalid push target %s: %s", target, err)
+	}
+	spm := asgi.ServerPushMessage{Request: asgi.RequestMessage{
+		Method:      "GET",
+		Path:        u.Path,
+		QueryString: []byte(u.RawQuery),
+		Headers:     make(http.Header),
+	}}
+	if opts != nil {
+		if opts.Method != "" {
+			spm.Request.Method = opts.Method
+		}
+		if opts.Header != nil {
+			spm.Request.Headers = opts.Header
+		}
+	}
+
+	// The push message has to be send after the response message.
+	w.Flush()
+	if w.err != nil {
+		return w.err
+	}
+	return send(w.layer, w.channel, spm.Raw())
+}
+
+// finish sends the rest of the response.
+func (w *responseWriter) finish() error {
+	if w.err != nil {
+		return w.err
+	}
+	return w.send(false)
+}
+
+// send sends the buffered content in messages of at most responseChunkSize.
+func (w *responseWriter) send(moreContent bool) error {
+	w.WriteHeader(http.StatusOK)
+	for {
+		content := w.buf.Next(responseChunkSize)
+		more := moreContent || w.buf.Len() > 0
+
+		var message asgi.Message
+		if !w.headerSent {
+			rm := asgi.ResponseMessage{Status: w.status, Headers: w.header}
+			rm.Content = content
+			rm.MoreContent = more
+			message = rm.Raw()
+			w.headerSent = true
+		} else {
+			if len(content) == 0 && more {
+				// Nothing to send
+				return nil
+			}
+			rcm := asgi.ResponseChunkMessage{Content: content, MoreContent: more}
+			message = rcm.Raw()
+		}
+
+		if err := send(w.layer, w.channel, message); err != nil {
+			return fmt.Errorf("can not send the response: %s", err)
+		}
+		if w.buf.Len() == 0 {
+			return nil
+		}
+	}
+}
@@ -0,0 +1,50 @@
+package worker
+
+import (
+	"github.com/ostcar/geiss/asgi"
+)
+
+// WebsocketConn sends messages to a websocket client.
+type WebsocketConn struct {
+	layer        asgi.ChannelLayer
+	ReplyChannel string
+}
+
+// NewWebsocketConn returns a WebsocketConn to the client with the reply
+// channel. It can be used to send messages to a client from outside of a
+// WebsocketHandler.
+func NewWebsocketConn(layer asgi.ChannelLayer, replyChannel string) *WebsocketConn {
+	return &WebsocketConn{layer: layer, ReplyChannel: replyChannel}
+}
+
+// Send sends a message to the client.
+func (c *WebsocketConn) Send(message *asgi.SendCloseAcceptMessage) error {
+	return send(c.layer, c.ReplyChannel, message.Raw())
+}
+
+// Accept accepts the websocket connection. It has to be called from
+// WebsocketHandler.Connect.
+func (c *WebsocketConn) Accept() error {
+	return c.Send(&asgi.SendCloseAcceptMessage{Accept: true})
+}
+
+// Reject rejects the websocket connection. It has to be called from
+// WebsocketHandler.Connect.
+func (c *WebsocketConn) Reject() error {
+	return c.Send(&asgi.SendCloseAcceptMessage{Close: 1000})
+}
+
+// SendText sends a text message to the client.
+func (c *WebsocketConn) SendText(text string) error {
+	return c.Send(&asgi.SendCloseAcceptMessage{Text: text})
+}
+
+// SendBytes sends a binary message to the client.
+func (c *WebsocketConn) SendBytes(b []byte) error {
+	return c.Send(&asgi.SendCloseAcceptMessage{Bytes: b})
+}
+
+// Close closes the connection with the close code.
+func (c *WebsocketConn) Close(code int) error {
+	return c.Send(&asgi.SendCloseAcceptMessage{Close: code})
+}
@@ -0,0 +1,177 @@
+/*
+Package worker implements the consumer side of asgi. A Worker receives the
+messages that a protocol server like Geiss sends to the channel layer and calls
+handlers for them.
+
+It can be used to serve some endpoints with go, while the other endpoints are
+still served by django workers:
+
+	w := &worker.Worker{
+		Layer: layer,
+		HTTP:  worker.HTTP(myHandler),
+	}
+	w.Run(nil)
+*/
+package worker
+
+import (
+	"fmt"
+	"log"
+	"sync"
+	"time"
+
+	"github.com/ostcar/geiss/asgi"
+)
+
+const (
+	// Default number of goroutines that receive messages.
+	defaultConcurrency = 10
+
+	// Time to wait after the channel layer returned an error.
+	errorWait = time.Second
+
+	// Time to retry a message, if the channel is full.
+	sendRetry = 5 * time.Second
+)
+
+// HTTPHandler handles http requests from the channel "http.request". It has to
+// send the response to the reply channel of the request.
+type HTTPHandler interface {
+	ServeASGI(layer asgi.ChannelLayer, request *asgi.RequestMessage) error
+}
+
+// WebsocketHandler handles the websocket messages from the channels
+// "websocket.connect", "websocket.receive" and "websocket.disconnect".
+type WebsocketHandler interface {
+	// Connect is called for a new websocket connection. It has to accept or
+	// reject the connection with the methods of the WebsocketConn.
+	Connect(conn *WebsocketConn, message *asgi.ConnectionMessage) error
+
+	// Receive is called for each message from the client.
+	Receive(conn *WebsocketConn, message *asgi.ReceiveMessage) error
+
+	// Disconnect is called after the connection was closed.
+	Disconnect(message *asgi.DisconnectionMessage) error
+}
+
+// Worker receives messages from the channel layer and calls the handlers for
+// them. If a handler is nil, then the messages for it are not received, so they
+// can be handled by other workers.
+type Worker struct {
+	Layer     asgi.ChannelLayer
+	HTTP      HTTPHandler
+	Websocket WebsocketHandler
+
+	// Number of messages that are handled at the same time. Defaults to 10.
+	Concurrency int
+}
+
+// channels returns the asgi channels, that the worker has handlers for.
+func (w *Worker) channels() []string {
+	var channels []string
+	if w.HTTP != nil {
+		channels = append(channels, "http.request")
+	}
+	if w.Websocket != nil {
+		channels = append(channels, "websocket.connect", "websocket.receive", "websocket.disconnect")
+	}
+	return channels
+}
+
+// Run receives messages until done is closed. Errors from the channel layer and
+// the handlers are logged. done can be nil to run forever.
+func (w *Worker) Run(done <-chan struct{}) error {
+	channels := w.channels()
+	if len(channels) == 0 {
+		return fmt.Errorf("the worker has no handlers")
+	}
+
+	concurrency := w.Concurrency
+	if concurrency == 0 {
+		concurrency = defaultConcurrency
+	}
+
+	var wg sync.WaitGroup
+	for i := 0; i < concurrency; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for {
+				select {
+				case <-done:
+					return
+				default:
+				}
+
+				channel, message, err := w.Layer.Receive(channels, true)
+				if err != nil {
+					log.Printf("Error: Can not receive a message: %s", err)
+					time.Sleep(errorWait)
+					continue
+				}
+				if channel == "" {
+					// Got timeout
+					continue
+				}
+				if err := w.handle(channel, message); err != nil {
+					log.Printf("Error: Can not handle a message on %s: %s", channel, err)
+				}
+			}
+		}()
+	}
+	wg.Wait()
+	return nil
+}
+
+// handle calls the handler for a message.
+func (w *Worker) handle(channel string, message asgi.Message) (err error) {
+	defer func() {
+		if r := recover(); r != nil {
+			err = fmt.Errorf("handler panicked: %v", r)
+		}
+	}()
+
+	switch channel {
+	case "http.request":
+		var rm asgi.RequestMessage
+		if err := rm.Set(message); err != nil {
+			return err
+		}
+		return w.HTTP.ServeASGI(w.Layer, &rm)
+
+	case "websocket.connect":
+		var cm asgi.ConnectionMessage
+		if err := cm.Set(message); err != nil {
+			return err
+		}
+		return w.Websocket.Connect(&WebsocketConn{layer: w.Layer, ReplyChannel: cm.ReplyChannel}, &cm)
+
+	case "websocket.receive":
+		var rm asgi.ReceiveMessage
+		if err := rm.Set(message); err != nil {
+			return err
+		}
+		return w.Websocket.Receive(&WebsocketConn{layer: w.Layer, ReplyChannel: rm.ReplyChannel}, &rm)
+
+	case "websocket.disconnect":
+		var dm asgi.DisconnectionMessage
+		if err := dm.Set(message); err != nil {
+			return err
+		}
+		return w.Websocket.Disconnect(&dm)
+	}
+	return fmt.Errorf("got a message on the unknown channel %s", channel)
+}
+
+// send sends a message to a channel. If the channel is full, then it tries again
+// for some time.
+func send(layer asgi.ChannelLayer, channel string, message asgi.Message) error {
+	deadline := time.Now().Add(sendRetry)
+	for {
+		err := layer.Send(channel, message)
+		if !asgi.IsChannelFullError(err) || time.Now().After(deadline) {
+			return err
+		}
+		time.Sleep(100 * time.Millisecond)
+	}
+}
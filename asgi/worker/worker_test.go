@@ -0,0 +1,228 @@
+package worker
+
+import (
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"testing"
+
+	"github.com/ostcar/geiss/asgi"
+	"github.com/ostcar/geiss/asgi/memory"
+
+	"github.com/gorilla/websocket"
+)
+
+// receive receives one message from a process specific channel and fails the
+// test, if there is none.
+func receive(t *testing.T, layer asgi.ChannelLayer, channel string) asgi.Message {
+	nonLocal, _ := asgi.ProcessLocal(channel, nil)
+	c, message, err := layer.Receive([]string{nonLocal}, true)
+	if err != nil {
+		t.Fatalf("Did not expect an error, got %s", err)
+	}
+	if c != channel {
+		t.Fatalf("Expected a message on %s, got one on \"%s\"", channel, c)
+	}
+	return message
+}
+
+func TestHTTP(t *testing.T) {
+	layer := memory.NewChannelLayer(0, 0)
+	done := make(chan struct{})
+	defer close(done)
+
+	w := &Worker{
+		Layer: layer,
+		HTTP: HTTP(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			body, err := ioutil.ReadAll(r.Body)
+			if err != nil {
+				http.Error(w, err.Error(), 500)
+				return
+			}
+			w.Header().Set("Content-Type", "text/plain")
+			w.WriteHeader(201)
+			fmt.Fprintf(w, "%s %s?%s %s", r.Method, r.URL.Path, r.URL.RawQuery, body)
+		})),
+		Concurrency: 2,
+	}
+	go w.Run(done)
+
+	headers := make(http.Header)
+	headers.Set("Host", "example.com")
+	request := asgi.RequestMessage{
+		ReplyChannel: "test.response!abc",
+		HTTPVersion:  "1.1",
+		Method:       "POST",
+		Scheme:       "http",
+		Path:         "/echo/",
+		QueryString:  []byte("a=1"),
+		Headers:      headers,
+		Body:         []byte("first "),
+		BodyChannel:  "http.request.body?abc",
+		Client:       "127.0.0.1:1234",
+		Server:       "127.0.0.1:8000",
+	}
+	if err := layer.Send("http.request", request.Raw()); err != nil {
+		t.Fatalf("Did not expect an error, got %s", err)
+	}
+	for _, chunk := range []asgi.RequestBodyChunkMessage{
+		{Content: []byte("second "), MoreContent: true},
+		{Content: []byte("third"), MoreContent: false},
+	} {
+		if err := layer.Send(request.BodyChannel, chunk.Raw()); err != nil {
+			t.Fatalf("Did not expect an error, got %s", err)
+		}
+	}
+
+	var response asgi.ResponseMessage
+	if err := response.Set(receive(t, layer, request.ReplyChannel)); err != nil {
+		t.Fatalf("Did not expect an error, got %s", err)
+	}
+	if response.Status != 201 || response.Headers.Get("Content-Type") != "text/plain" {
+		t.Errorf("Got a wrong response: %d %v", response.Status, response.Headers)
+	}
+	if expected := "POST /echo/?a=1 first second third"; string(response.Content) != expected {
+		t.Errorf("Expected the content \"%s\", got \"%s\"", expected, response.Content)
+	}
+	if response.MoreContent {
+		t.Errorf("Expected the response to be complete")
+	}
+}
+
+func TestHTTPChunkedResponse(t *testing.T) {
+	layer := memory.NewChannelLayer(0, 0)
+	big := bytes.Repeat([]byte("x"), responseChunkSize+10)
+	w := HTTP(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("flushed"))
+		w.(http.Flusher).Flush()
+		w.Write(big)
+	}))
+	if err := w.ServeASGI(layer, &asgi.RequestMessage{ReplyChannel: "test.response!abc", Method: "GET", Path: "/"}); err != nil {
+		t.Fatalf("Did not expect an error, got %s", err)
+	}
+
+	var response asgi.ResponseMessage
+	response.Set(receive(t, layer, "test.response!abc"))
+	if response.Status != 200 || string(response.Content) != "flushed" || !response.MoreContent {
+		t.Errorf("Expected the flushed content as first message, got %d %s", response.Status, response.Content)
+	}
+
+	var content []byte
+	for more := true; more; {
+		var chunk asgi.ResponseChunkMessage
+		if err := chunk.Set(receive(t, layer, "test.response!abc")); err != nil {
+			t.Fatalf("Did not expect an error, got %s", err)
+		}
+		content = append(content, chunk.Content...)
+		more = chunk.MoreContent
+	}
+	if !bytes.Equal(content, big) {
+		t.Errorf("Expected to receive %d bytes in chunks, got %d", len(big), len(content))
+	}
+}
+
+func TestHTTPPush(t *testing.T) {
+	layer := memory.NewChannelLayer(0, 0)
+	w := HTTP(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if err := w.(http.Pusher).Push("/style.css?v=1", nil); err != nil {
+			t.Errorf("Did not expect an error, got %s", err)
+		}
+		w.Write([]byte("<html></html>"))
+	}))
+	w.ServeASGI(layer, &asgi.RequestMessage{ReplyChannel: "test.response!abc", Method: "GET", Path: "/"})
+
+	var response asgi.ResponseMessage
+	response.Set(receive(t, layer, "test.response!abc"))
+	if !response.MoreContent {
+		t.Errorf("Expected the response to have more content after the push")
+	}
+
+	message := receive(t, layer, "test.response!abc")
+	var push asgi.ServerPushMessage
+	if !asgi.IsServerPush(message) || push.Set(message) != nil {
+		t.Fatalf("Expected a server push message, got %v", message)
+	}
+	if push.Request.Path != "/style.css" || string(push.Request.QueryString) != "v=1" || push.Request.Method != "GET" {
+		t.Errorf("Got a wrong push request: %+v", push.Request)
+	}
+
+	var chunk asgi.ResponseChunkMessage
+	chunk.Set(receive(t, layer, "test.response!abc"))
+	if string(chunk.Content) != "<html></html>" || chunk.MoreContent {
+		t.Errorf("Expected the rest of the response, got %+v", chunk)
+	}
+}
+
+func TestHTTPPanic(t *testing.T) {
+	layer := memory.NewChannelLayer(0, 0)
+	w := HTTP(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		panic("oops")
+	}))
+	w.ServeASGI(layer, &asgi.RequestMessage{ReplyChannel: "test.response!abc", Method: "GET", Path: "/"})
+
+	var response asgi.ResponseMessage
+	response.Set(receive(t, layer, "test.response!abc"))
+	if response.Status != 500 {
+		t.Errorf("Expected the status 500 after a panic, got %d", response.Status)
+	}
+}
+
+type echoHandler struct {
+	disconnected chan int
+}
+
+func (h echoHandler) Connect(conn *WebsocketConn, m *asgi.ConnectionMessage) error {
+	if m.Path != "/ws/" {
+		return conn.Reject()
+	}
+	return conn.Accept()
+}
+
+func (h echoHandler) Receive(conn *WebsocketConn, m *asgi.ReceiveMessage) error {
+	return conn.SendText("echo: " + string(m.Content))
+}
+
+func (h echoHandler) Disconnect(m *asgi.DisconnectionMessage) error {
+	h.disconnected <- m.Code
+	return nil
+}
+
+func TestWebsocket(t *testing.T) {
+	layer := memory.NewChannelLayer(0, 0)
+	done := make(chan struct{})
+	defer close(done)
+
+	handler := echoHandler{disconnected: make(chan int, 1)}
+	w := &Worker{Layer: layer, Websocket: handler}
+	go w.Run(done)
+
+	connect := asgi.ConnectionMessage{ReplyChannel: "test.send!abc", Path: "/ws/"}
+	layer.Send("websocket.connect", connect.Raw())
+	var accept asgi.SendCloseAcceptMessage
+	accept.Set(receive(t, layer, "test.send!abc"))
+	if !accept.Accept {
+		t.Errorf("Expected the connection to be accepted")
+	}
+
+	message := asgi.ReceiveMessage{ReplyChannel: "test.send!abc", Path: "/ws/", Content: []byte("hello"), Type: websocket.TextMessage}
+	layer.Send("websocket.receive", message.Raw())
+	var answer asgi.SendCloseAcceptMessage
+	answer.Set(receive(t, layer, "test.send!abc"))
+	if answer.Text != "echo: hello" {
+		t.Errorf("Expected the answer \"echo: hello\", got \"%s\"", answer.Text)
+	}
+
+	disconnect := asgi.DisconnectionMessage{ReplyChannel: "test.send!abc", Code: 1001, Path: "/ws/"}
+	layer.Send("websocket.disconnect", disconnect.Raw())
+	if code := <-handler.disconnected; code != 1001 {
+		t.Errorf("Expected the close code 1001, got %d", code)
+	}
+}
+
+func TestRunWithoutHandlers(t *testing.T) {
+	w := &Worker{Layer: memory.NewChannelLayer(0, 0)}
+	if err := w.Run(nil); err == nil {
+		t.Errorf("Expected an error for a worker without handlers")
+	}
+}
@@ -0,0 +1,63 @@
+package main
+
+import (
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/ostcar/geiss/asgi"
+)
+
+func TestReadFromChannelOrder(t *testing.T) {
+	channel := globalChannelname + "TestReadFromChannelOrder"
+	c, done := readFromChannel(channel)
+	defer close(done)
+
+	// Send more messages then the buffer of the receiver can hold, before the
+	// receiver reads them.
+	count := 3 * receiverBuffer
+	for i := 0; i < count; i++ {
+		rcm := asgi.ResponseChunkMessage{Content: []byte(strconv.Itoa(i)), MoreContent: true}
+		if err := channelLayer.Send(channel, rcm.Raw()); err != nil {
+			t.Fatalf("Did not expect an error, got %s", err)
+		}
+	}
+	time.Sleep(100 * time.Millisecond)
+
+	for i := 0; i < count; i++ {
+		message, err := readTimeout(c, time.Second, nil)
+		if err != nil {
+			t.Fatalf("Did not expect an error, got %s", err)
+		}
+		var rcm asgi.ResponseChunkMessage
+		rcm.Set(message)
+		if string(rcm.Content) != strconv.Itoa(i) {
+			t.Fatalf("Expected the chunk %d, got %s", i, rcm.Content)
+		}
+	}
+}
+
+func TestQueueMessagesLimit(t *testing.T) {
+	in := make(chan asgi.Message)
+	out := make(chan asgi.Message)
+	defer close(in)
+	go queueMessages("TestQueueMessagesLimit", in, out)
+
+	// Nobody reads from out, so the messages after receiverQueue are dropped.
+	for i := 0; i < receiverQueue+10; i++ {
+		in <- asgi.Message{"content": i}
+	}
+
+	for i := 0; i < receiverQueue; i++ {
+		message, err := readTimeout(out, time.Second, nil)
+		if err != nil {
+			t.Fatalf("Did not expect an error, got %s", err)
+		}
+		if message["content"] != i {
+			t.Fatalf("Expected the message %d, got %v", i, message["content"])
+		}
+	}
+	if _, err := readTimeout(out, 100*time.Millisecond, nil); err != errTimeout {
+		t.Errorf("Expected the messages after %d to be dropped", receiverQueue)
+	}
+}
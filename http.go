@@ -1,8 +1,11 @@
 package main
 
 import (
+	"errors"
 	"fmt"
 	"io"
+	"log"
+	"net"
 	"net/http"
 	"strings"
 	"time"
@@ -11,10 +14,13 @@ import (
 )
 
 const (
-	httpResponseWait = 30 * time.Second
-	bodyChunkSize    = 500 * 1024 // Read 500kb at once
+	bodyChunkSize = 500 * 1024 // Read 500kb at once
 )
 
+// errChunkTimeout is returned, when the first part of a response was sent to
+// the client but the next chunk was not received in time.
+var errChunkTimeout = errors.New("could not receive the next response chunk in time")
+
 // readBodyChunk reads bodyChunkSize bytes from an io.Reader, and returns it as
 // first argument. eof is true when there is no more content after this call.
 func readBodyChunk(body io.Reader) (content []byte, eof bool, err error) {
@@ -37,6 +43,106 @@ func createResponseReplyChannel() (replyChannel string, err error) {
 	return replyChannel, nil
 }
 
+// requestScheme returns the scheme of a request. It is http or https for http
+// requests and ws or wss for websocket connections. For requests from a trusted
+// proxy, the scheme of the original request is used.
+func requestScheme(req *http.Request, websocket bool) string {
+	secure := req.TLS != nil
+	if info, ok := proxyInfo(req); ok && info.proto != "" {
+		secure = info.proto == "https" || info.proto == "wss"
+	}
+	switch {
+	case websocket && secure:
+		return "wss"
+	case websocket:
+		return "ws"
+	case secure:
+		return "https"
+	default:
+		return "http"
+	}
+}
+
+// rootPath is the url prefix, under which the application is mounted. It is
+// sent as root_path and is not part of the path in the messages.
+var rootPath string
+
+// splitRootPath returns the root path and the path of the request without
+// it. For requests from a trusted proxy, the X-Script-Name header is used as
+// root path. The path is only stripped, if it starts with the root path,
+// because some proxies strip it themselves.
+func splitRootPath(req *http.Request) (root, path string) {
+	root = rootPath
+	if isTrustedProxy(req.RemoteAddr) && req.Header.Get("X-Script-Name") != "" {
+		root = strings.TrimSuffix(req.Header.Get("X-Script-Name"), "/")
+	}
+
+	path = req.URL.Path
+	if root == "" || !strings.HasPrefix(path, root) {
+		return root, path
+	}
+	rest := path[len(root):]
+	if rest == "" {
+		return root, "/"
+	}
+	if rest[0] != '/' {
+		// The path is something like /appendix for the root path /app
+		return root, path
+	}
+	return root, rest
+}
+
+// clientAddress returns the address of the client. For requests from a
+// trusted proxy, the client from the proxy headers is used. The port of this
+// client is not known, so it is 0.
+func clientAddress(req *http.Request) string {
+	if info, ok := proxyInfo(req); ok && info.client != "" {
+		return net.JoinHostPort(info.client, "0")
+	}
+	return req.RemoteAddr
+}
+
+// serverAddress returns the local address, on which the request was received.
+// If it is not known, then the host of the request is used. For requests from
+// a trusted proxy, the host of the original request is used, if it is valid.
+func serverAddress(req *http.Request) string {
+	if info, ok := proxyInfo(req); ok && info.host != "" {
+		if addr, ok := forwardedServer(req, info); ok {
+			return addr
+		}
+	}
+	if addr, ok := req.Context().Value(http.LocalAddrContextKey).(net.Addr); ok {
+		return addr.String()
+	}
+	if req.TLS != nil && !strings.Contains(req.Host, ":") {
+		// If no port was set in the host explicitly, the asgi implementation uses
+		// 80 as default. So if the request is a https request, we have to manually
+		// set it to 443
+		return req.Host + ":443"
+	}
+	return req.Host
+}
+
+// forwardedServer returns the address of the original request from the proxy
+// headers. ok is false, if the host or the port in the headers is invalid.
+func forwardedServer(req *http.Request, info forwardedInfo) (addr string, ok bool) {
+	host, port, err := net.SplitHostPort(info.host)
+	if err != nil {
+		// The host has no port.
+		host, port = strings.Trim(info.host, "[]"), info.port
+		if port == "" {
+			port = "80"
+			if requestScheme(req, false) == "https" {
+				port = "443"
+			}
+		}
+	}
+	if !validHost(host) || !validPort(port) {
+		return "", false
+	}
+	return net.JoinHostPort(host, port), true
+}
+
 // Forwards a HTTP request to the channel layer. Returns the reply channel name.
 func forwardHTTPRequest(req *http.Request, replyChannel string) (err error) {
 	var bodyChannel string
@@ -55,26 +161,20 @@ func forwardHTTPRequest(req *http.Request, replyChannel string) (err error) {
 		}
 	}
 
-	host := req.Host
-	if req.TLS != nil && !strings.Contains(req.Host, ":") {
-		// If no port was set in the host explicitly, the asgi implementation uses
-		// 80 as default. So if the request is a https request, we have to manually
-		// set it to 443
-		host = req.Host + ":443"
-	}
-
+	root, path := splitRootPath(req)
 	rm := asgi.RequestMessage{
 		ReplyChannel: replyChannel,
 		HTTPVersion:  req.Proto,
 		Method:       req.Method,
-		Path:         req.URL.Path,
-		Scheme:       req.URL.Scheme,
+		Path:         path,
+		RootPath:     root,
+		Scheme:       requestScheme(req, false),
 		QueryString:  []byte(req.URL.RawQuery),
 		Headers:      req.Header,
 		Body:         content,
 		BodyChannel:  bodyChannel,
-		Client:       req.RemoteAddr,
-		Server:       host,
+		Client:       clientAddress(req),
+		Server:       serverAddress(req),
 	}
 
 	// Send the Request message to the channel layer
@@ -90,17 +190,22 @@ func forwardHTTPRequest(req *http.Request, replyChannel string) (err error) {
 	return nil
 }
 
+// sendMoreContent reads the rest of the body and sends it to the body channel.
+// If the body can not be read, because the client closed the connection, then
+// a last message with Closed=true is sent, so the worker stops waiting for the
+// body.
 func sendMoreContent(body io.Reader, channel string) (err error) {
 	// Read more content from the body
-	content, eof, err := readBodyChunk(body)
-	if err != nil {
-		return asgi.NewForwardError("can not read the body of the request", err)
+	content, eof, readErr := readBodyChunk(body)
+	closed := readErr != nil
+	if closed {
+		eof = true
 	}
 
 	for i := 0; ; i++ {
 		rbc := asgi.RequestBodyChunkMessage{
 			Content:     content,
-			Closed:      false, // TODO test if the connection is closed
+			Closed:      closed,
 			MoreContent: !eof,
 		}
 		err = channelLayer.Send(channel, rbc.Raw())
@@ -114,6 +219,9 @@ func sendMoreContent(body io.Reader, channel string) (err error) {
 		}
 		break
 	}
+	if closed {
+		return asgi.NewForwardError("can not read the body of the request", readErr)
+	}
 	if !eof {
 		return sendMoreContent(body, channel)
 	}
@@ -121,14 +229,21 @@ func sendMoreContent(body io.Reader, channel string) (err error) {
 }
 
 // Receives a http response from the channel layer and writes it to the http response.
-func receiveHTTPResponse(w http.ResponseWriter, channel string) (err error) {
+// If closed is closed before the response was received, then it returns
+// errClientGone. The timeouts for the path are used to wait for the messages.
+// If the first message is not received in time, then errTimeout is returned.
+// If a later chunk is not received in time, then errChunkTimeout is returned.
+// root is the root path of the request. It is used for pushed resources.
+func receiveHTTPResponse(w http.ResponseWriter, channel, root, path string, closed <-chan struct{}) (err error) {
 	// Register the asgi channel to listen on.
 	c, done := readFromChannel(channel)
 	defer close(done)
 
 	// Wait for the response
-	message, err := readTimeout(c, httpResponseWait)
-	if err != nil {
+	message, err := readTimeout(c, responseTimeout.forPath(path), closed)
+	if err == errClientGone || err == errTimeout {
+		return err
+	} else if err != nil {
 		return fmt.Errorf("Can not read from channel %s: %s", channel, err)
 	}
 
@@ -140,21 +255,44 @@ func receiveHTTPResponse(w http.ResponseWriter, channel string) (err error) {
 		w.Header()[k] = v
 	}
 
+	// The go http server decides, if the response uses chunked transfer encoding.
+	// It uses it, when there is no Content-Length and the response is flushed.
+	w.Header().Del("Transfer-Encoding")
+
 	// Set the status code of the http response and write the first part of the content
 	w.WriteHeader(rm.Status)
 	if _, err = w.Write(rm.Content); err != nil {
 		return asgi.NewForwardError("can not write to response", err)
 	}
+	if rm.MoreContent {
+		// Send the headers and the first part at once, so streamed responses like
+		// server sent events are not buffered.
+		flush(w)
+	}
 
 	// If there is more content, then receive it
 	moreContent := rm.MoreContent
 	for moreContent {
 		// Wait for the response
-		message, err = readTimeout(c, httpResponseWait)
-		if err != nil {
+		message, err = readTimeout(c, chunkTimeout.forPath(path), closed)
+		if err == errClientGone {
+			return err
+		} else if err == errTimeout {
+			return errChunkTimeout
+		} else if err != nil {
 			return fmt.Errorf("Can not read from channel %s: %s", channel, err)
 		}
 
+		// A server push message can be send between the response chunks.
+		if asgi.IsServerPush(message) {
+			var spm asgi.ServerPushMessage
+			if err = spm.Set(message); err != nil {
+				return fmt.Errorf("Received an invalid server push message: %s", err)
+			}
+			pushResource(w, root, &spm.Request)
+			continue
+		}
+
 		var rcm asgi.ResponseChunkMessage
 		rcm.Set(message)
 
@@ -162,6 +300,7 @@ func receiveHTTPResponse(w http.ResponseWriter, channel string) (err error) {
 		if _, err = w.Write(rcm.Content); err != nil {
 			return asgi.NewForwardError("can not write to response", err)
 		}
+		flush(w)
 
 		// See if there is still more content.
 		moreContent = rcm.MoreContent
@@ -169,6 +308,64 @@ func receiveHTTPResponse(w http.ResponseWriter, channel string) (err error) {
 	return nil
 }
 
+// flush sends the buffered content of the response to the client, if the
+// response writer supports it.
+func flush(w http.ResponseWriter) {
+	if f, ok := w.(http.Flusher); ok {
+		f.Flush()
+	}
+}
+
+// Headers that are not allowed in the request of a HTTP/2 server push.
+var forbiddenPushHeaders = []string{"Content-Length", "Content-Encoding", "Trailer", "Te", "Expect", "Host"}
+
+// pushResource pushes a resource to the client with HTTP/2 server push. It does
+// nothing, if the connection does not support server push, for example with
+// HTTP/1.1. The path of the message does not contain the root path. If the
+// message has no root path, then root is used.
+func pushResource(w http.ResponseWriter, root string, rm *asgi.RequestMessage) {
+	pusher, ok := w.(http.Pusher)
+	if !ok {
+		return
+	}
+
+	if rm.RootPath != "" {
+		root = rm.RootPath
+	}
+	target := root + rm.Path
+	if len(rm.QueryString) > 0 {
+		target += "?" + string(rm.QueryString)
+	}
+	method := rm.Method
+	if method == "" {
+		method = "GET"
+	}
+	header := make(http.Header)
+	for k, v := range rm.Headers {
+		header[k] = v
+	}
+	for _, k := range forbiddenPushHeaders {
+		header.Del(k)
+	}
+
+	err := pusher.Push(target, &http.PushOptions{Method: method, Header: header})
+	if err != nil && err != http.ErrNotSupported {
+		log.Printf("Error: Can not push %s: %s", target, err)
+	}
+}
+
+// sendHTTPDisconnect sends a http.disconnect message to the channel layer, when
+// the client closed the connection before the response was sent.
+func sendHTTPDisconnect(replyChannel string, path string) {
+	dm := asgi.HTTPDisconnectMessage{
+		ReplyChannel: replyChannel,
+		Path:         path,
+	}
+	if err := channelLayer.Send("http.disconnect", dm.Raw()); err != nil {
+		log.Printf("Error: Can not send http.disconnect for %s: %s", path, err)
+	}
+}
+
 // Handels an http request. Returns an error if it happens.
 func asgiHTTPHandler(w http.ResponseWriter, req *http.Request) error {
 	// Get the reply channel name
@@ -188,7 +385,26 @@ func asgiHTTPHandler(w http.ResponseWriter, req *http.Request) error {
 
 	// Receive the response from the channel layer and write it to the http
 	// response.
-	if err = receiveHTTPResponse(w, channel); err != nil {
+	// The timeout rules use the path without the root path, like the worker.
+	root, path := splitRootPath(req)
+	err = receiveHTTPResponse(w, channel, root, path, req.Context().Done())
+	switch err {
+	case errClientGone:
+		// Tell the worker, that nobody is waiting for the response anymore.
+		sendHTTPDisconnect(channel, path)
+		return nil
+	case errTimeout:
+		sendHTTPDisconnect(channel, path)
+		handleError(w, fmt.Sprintf("no response for %s in time", req.URL.Path), http.StatusGatewayTimeout)
+		return nil
+	case errChunkTimeout:
+		// The status code was already sent. Abort the response, so the client
+		// knows, that it is incomplete.
+		sendHTTPDisconnect(channel, path)
+		log.Printf("Error: %s for %s", err, req.URL.Path)
+		panic(http.ErrAbortHandler)
+	}
+	if err != nil {
 		return asgi.NewForwardError(
 			"could not receive message from the http response channel", err)
 	}
@@ -2,17 +2,23 @@ package main
 
 import (
 	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
 	"net/http"
 	"net/http/httptest"
 	"strings"
 	"testing"
+	"time"
 
 	"github.com/ostcar/geiss/asgi"
-	"github.com/ostcar/geiss/asgi/redis"
+	"github.com/ostcar/geiss/asgi/memory"
 )
 
 func init() {
-	channelLayer = redis.NewChannelLayer(0, "", "http_test:", 0)
+	channelLayer = memory.NewChannelLayer(0, 0)
 	go globalReceive()
 }
 
@@ -76,6 +82,74 @@ func TestForwardHTTPRequest(t *testing.T) {
 		if d.message["body_channel"] != "" {
 			t.Errorf("Expected the body_channel to be empty")
 		}
+		scheme := "http"
+		if request.TLS != nil {
+			scheme = "https"
+		}
+		if d.message["scheme"] != scheme {
+			t.Errorf("Expected the scheme %s, got %v", scheme, d.message["scheme"])
+		}
+	}
+}
+
+func TestForwardHTTPRequestAddresses(t *testing.T) {
+	localAddr := &net.TCPAddr{IP: net.ParseIP("10.0.0.1"), Port: 8000}
+	request := httptest.NewRequest("GET", "https://example.com/", nil)
+	request = request.WithContext(context.WithValue(request.Context(), http.LocalAddrContextKey, localAddr))
+	request.RemoteAddr = "192.168.0.5:54321"
+
+	if err := forwardHTTPRequest(request, "some-channel"); err != nil {
+		t.Fatalf("Did not expect an error, got %s", err)
+	}
+	_, message, err := channelLayer.Receive([]string{"http.request"}, false)
+	if err != nil {
+		t.Fatalf("Did not expect an error, got %s", err)
+	}
+	var rm asgi.RequestMessage
+	if err := rm.Set(message); err != nil {
+		t.Fatalf("Did not expect an error, got %s", err)
+	}
+	if rm.Client != "192.168.0.5:54321" {
+		t.Errorf("Expected the client 192.168.0.5:54321, got %s", rm.Client)
+	}
+	if rm.Server != "10.0.0.1:8000" {
+		t.Errorf("Expected the server 10.0.0.1:8000, got %s", rm.Server)
+	}
+	if rm.Scheme != "https" {
+		t.Errorf("Expected the scheme https, got %s", rm.Scheme)
+	}
+}
+
+func TestForwardHTTPRequestInvalidProxyHeaders(t *testing.T) {
+	defer func(old []*net.IPNet) { trustedProxies = old }(trustedProxies)
+	trustedProxies, _ = parseTrustedProxies([]string{"10.0.0.0/8"})
+
+	localAddr := &net.TCPAddr{IP: net.ParseIP("10.0.0.1"), Port: 8000}
+	for _, header := range []map[string]string{
+		{"X-Forwarded-Host": "example.org", "X-Forwarded-Port": "abc"},
+		{"Forwarded": `host="x:y"`},
+	} {
+		request := httptest.NewRequest("GET", "http://example.com/", nil)
+		request = request.WithContext(context.WithValue(request.Context(), http.LocalAddrContextKey, localAddr))
+		request.RemoteAddr = "10.0.0.2:54321"
+		for k, v := range header {
+			request.Header.Set(k, v)
+		}
+
+		if err := forwardHTTPRequest(request, "some-channel"); err != nil {
+			t.Fatalf("Did not expect an error, got %s", err)
+		}
+		_, message, err := channelLayer.Receive([]string{"http.request"}, false)
+		if err != nil {
+			t.Fatalf("Did not expect an error, got %s", err)
+		}
+		var rm asgi.RequestMessage
+		if err := rm.Set(message); err != nil {
+			t.Fatalf("Did not expect an error, got %s", err)
+		}
+		if rm.Server != "10.0.0.1:8000" {
+			t.Errorf("Expected the local address 10.0.0.1:8000 for the headers %v, got %s", header, rm.Server)
+		}
 	}
 }
 
@@ -126,6 +200,35 @@ func TestForwardBigHTTPRequest(t *testing.T) {
 	}
 }
 
+func TestForwardAbortedHTTPRequest(t *testing.T) {
+	request := httptest.NewRequest("POST", "https://localhost", &abortedBody{size: bodyChunkSize + 10})
+	if err := forwardHTTPRequest(request, "some-channel"); err == nil {
+		t.Errorf("Expected an error for an aborted upload")
+	}
+
+	_, message, err := channelLayer.Receive([]string{"http.request"}, false)
+	if err != nil {
+		t.Fatalf("Did not expect an error, got %s", err)
+	}
+	var rm asgi.RequestMessage
+	rm.Set(message)
+	if rm.BodyChannel == "" {
+		t.Fatalf("Expected a body channel")
+	}
+
+	// The worker gets the part that was read and a message that the connection
+	// is closed.
+	channel, message, err := channelLayer.Receive([]string{rm.BodyChannel}, false)
+	if err != nil || channel == "" {
+		t.Fatalf("Expected a message on the body channel, got %v", err)
+	}
+	var chunk asgi.RequestBodyChunkMessage
+	chunk.Set(message)
+	if !chunk.Closed || chunk.MoreContent || len(chunk.Content) != 10 {
+		t.Errorf("Expected a last chunk with Closed=true, got %+v", chunk)
+	}
+}
+
 func TestReceiveHTTPResponse(t *testing.T) {
 	var d1 dummyMessanger
 	d1.message = make(asgi.Message)
@@ -143,7 +246,7 @@ func TestReceiveHTTPResponse(t *testing.T) {
 			t.Errorf("Did not expect an error, got %s", err)
 		}
 		response := httptest.NewRecorder()
-		err = receiveHTTPResponse(response, globalChannelname+"123")
+		err = receiveHTTPResponse(response, globalChannelname+"123", "", "/", nil)
 		if err != nil {
 			t.Fatalf("Did not expect an error, got %s", err)
 		}
@@ -174,12 +277,15 @@ func TestReceiveBigHTTPResponse(t *testing.T) {
 	go func() {
 		// Start by listning for response. This has to be done in parallel to
 		// sending the responses.
-		err := receiveHTTPResponse(response, globalChannelname+"TestReceiveBigHTTPResponse")
+		defer close(done)
+		err := receiveHTTPResponse(response, globalChannelname+"TestReceiveBigHTTPResponse", "", "/", nil)
 		if err != nil {
-			t.Fatalf("Did not expect an error, got %s", err)
+			t.Errorf("Did not expect an error, got %s", err)
 		}
-		close(done)
 	}()
+	// Give the receiver time to register the channel. The memory channel layer
+	// delivers the messages at once.
+	time.Sleep(100 * time.Millisecond)
 
 	var d1a, d1b dummyMessanger
 	d1a.message = make(asgi.Message)
@@ -257,3 +363,231 @@ func TestAsgiHTTPHandler(t *testing.T) {
 		t.Errorf("Did not expect an error, got %s", err)
 	}
 }
+
+// pushRecorder is a ResponseRecorder that supports HTTP/2 server push.
+type pushRecorder struct {
+	*httptest.ResponseRecorder
+	pushed []string
+}
+
+func (p *pushRecorder) Push(target string, opts *http.PushOptions) error {
+	p.pushed = append(p.pushed, opts.Method+" "+target)
+	return nil
+}
+
+func TestServerPush(t *testing.T) {
+	messages := []asgi.SendMessenger{
+		&asgi.ResponseMessage{
+			ResponseChunkMessage: asgi.ResponseChunkMessage{Content: []byte("<html>"), MoreContent: true},
+			Status:               200,
+		},
+		&asgi.ServerPushMessage{Request: asgi.RequestMessage{Method: "GET", Path: "/style.css", QueryString: []byte("v=1")}},
+		&asgi.ServerPushMessage{Request: asgi.RequestMessage{Method: "GET", Path: "/app.js", RootPath: "/static"}},
+		&asgi.ResponseChunkMessage{Content: []byte("</html>")},
+	}
+
+	for i, response := range []http.ResponseWriter{&pushRecorder{ResponseRecorder: httptest.NewRecorder()}, httptest.NewRecorder()} {
+		channel := fmt.Sprintf("%sTestServerPush%d", globalChannelname, i)
+		done := make(chan bool)
+		go func() {
+			defer close(done)
+			if err := receiveHTTPResponse(response, channel, "/app", "/", nil); err != nil {
+				t.Errorf("Did not expect an error, got %s", err)
+			}
+		}()
+		// Give the receiver time to register the channel.
+		time.Sleep(100 * time.Millisecond)
+
+		for _, m := range messages {
+			if err := channelLayer.Send(channel, m.Raw()); err != nil {
+				t.Errorf("Did not expect an error, got %s", err)
+			}
+		}
+		<-done
+
+		// Without support for server push, the message is ignored.
+		var recorder *httptest.ResponseRecorder
+		if p, ok := response.(*pushRecorder); ok {
+			// The path is prefixed with the root path of the message or of the
+			// request.
+			if len(p.pushed) != 2 || p.pushed[0] != "GET /app/style.css?v=1" || p.pushed[1] != "GET /static/app.js" {
+				t.Errorf("Expected /app/style.css?v=1 and /static/app.js to be pushed, got %v", p.pushed)
+			}
+			recorder = p.ResponseRecorder
+		} else {
+			recorder = response.(*httptest.ResponseRecorder)
+		}
+		if recorder.Body.String() != "<html></html>" {
+			t.Errorf("Expected the content \"<html></html>\", got \"%s\"", recorder.Body.String())
+		}
+	}
+}
+
+func TestAsgiHTTPHandlerDisconnect(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	request := httptest.NewRequest("GET", "/poll/", nil).WithContext(ctx)
+
+	done := make(chan bool)
+	go func() {
+		defer close(done)
+		if err := asgiHTTPHandler(httptest.NewRecorder(), request); err != nil {
+			t.Errorf("Did not expect an error, got %s", err)
+		}
+	}()
+
+	// The worker gets the request but does not answer. Then the client goes
+	// away.
+	_, message, err := channelLayer.Receive([]string{"http.request"}, true)
+	if err != nil {
+		t.Fatalf("Did not expect an error, got %s", err)
+	}
+	var rm asgi.RequestMessage
+	rm.Set(message)
+	cancel()
+
+	select {
+	case <-done:
+	case <-time.After(time.Second):
+		t.Fatalf("Expected the handler to stop waiting, when the client is gone")
+	}
+
+	channel, message, err := channelLayer.Receive([]string{"http.disconnect"}, false)
+	if err != nil || channel == "" {
+		t.Fatalf("Expected a message on http.disconnect, got %v", err)
+	}
+	var dm asgi.HTTPDisconnectMessage
+	dm.Set(message)
+	if dm.ReplyChannel != rm.ReplyChannel || dm.Path != "/poll/" {
+		t.Errorf("Got a wrong disconnect message: %+v", dm)
+	}
+}
+
+func TestStreamingHTTPResponse(t *testing.T) {
+	channel := globalChannelname + "TestStreamingHTTPResponse"
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if err := receiveHTTPResponse(w, channel, "", r.URL.Path, r.Context().Done()); err != nil {
+			t.Errorf("Did not expect an error, got %s", err)
+		}
+	}))
+	defer server.Close()
+
+	responses := make(chan *http.Response)
+	go func() {
+		resp, err := http.Get(server.URL)
+		if err != nil {
+			t.Errorf("Did not expect an error, got %s", err)
+			close(responses)
+			return
+		}
+		responses <- resp
+	}()
+	// Give the receiver time to register the channel.
+	time.Sleep(100 * time.Millisecond)
+
+	first := asgi.ResponseMessage{Status: 200, Headers: http.Header{"Content-Type": {"text/event-stream"}}}
+	first.Content = []byte("data: 1\n\n")
+	first.MoreContent = true
+	if err := channelLayer.Send(channel, first.Raw()); err != nil {
+		t.Fatalf("Did not expect an error, got %s", err)
+	}
+
+	// The client gets the first event before the response is finished.
+	resp, ok := <-responses
+	if !ok {
+		return
+	}
+	defer resp.Body.Close()
+	if len(resp.TransferEncoding) != 1 || resp.TransferEncoding[0] != "chunked" {
+		t.Errorf("Expected a chunked response, got %v", resp.TransferEncoding)
+	}
+	buf := make([]byte, len(first.Content))
+	if _, err := io.ReadFull(resp.Body, buf); err != nil || !bytes.Equal(buf, first.Content) {
+		t.Errorf("Expected to read the first event, got \"%s\" and %v", buf, err)
+	}
+
+	last := asgi.ResponseChunkMessage{Content: []byte("data: 2\n\n")}
+	if err := channelLayer.Send(channel, last.Raw()); err != nil {
+		t.Fatalf("Did not expect an error, got %s", err)
+	}
+	rest, err := ioutil.ReadAll(resp.Body)
+	if err != nil || string(rest) != "data: 2\n\n" {
+		t.Errorf("Expected to read the second event, got \"%s\" and %v", rest, err)
+	}
+}
+
+func TestAsgiHTTPHandlerTimeout(t *testing.T) {
+	defer func(old timeout) { responseTimeout = old }(responseTimeout)
+	responseTimeout = timeout{value: time.Hour}
+	if err := responseTimeout.addRule("/fast/=50ms"); err != nil {
+		t.Fatalf("Did not expect an error, got %s", err)
+	}
+
+	response := httptest.NewRecorder()
+	if err := asgiHTTPHandler(response, httptest.NewRequest("GET", "/fast/report/", nil)); err != nil {
+		t.Fatalf("Did not expect an error, got %s", err)
+	}
+	if response.Code != http.StatusGatewayTimeout {
+		t.Errorf("Expected the status 504, got %d", response.Code)
+	}
+
+	// The worker is told, that nobody waits for the response.
+	channelLayer.Receive([]string{"http.request"}, false)
+	channel, _, err := channelLayer.Receive([]string{"http.disconnect"}, false)
+	if err != nil || channel == "" {
+		t.Errorf("Expected a message on http.disconnect, got %v", err)
+	}
+}
+
+func TestAsgiHTTPHandlerTimeoutRootPath(t *testing.T) {
+	defer func(old timeout, root string) { responseTimeout, rootPath = old, root }(responseTimeout, rootPath)
+	responseTimeout = timeout{value: time.Hour}
+	if err := responseTimeout.addRule("/fast/=50ms"); err != nil {
+		t.Fatalf("Did not expect an error, got %s", err)
+	}
+	rootPath = "/app"
+
+	response := httptest.NewRecorder()
+	if err := asgiHTTPHandler(response, httptest.NewRequest("GET", "/app/fast/report/", nil)); err != nil {
+		t.Fatalf("Did not expect an error, got %s", err)
+	}
+	if response.Code != http.StatusGatewayTimeout {
+		t.Errorf("Expected the status 504, got %d", response.Code)
+	}
+
+	channelLayer.Receive([]string{"http.request"}, false)
+	channelLayer.Receive([]string{"http.disconnect"}, false)
+}
+
+func TestSplitRootPath(t *testing.T) {
+	defer func(old string, proxies []*net.IPNet) { rootPath, trustedProxies = old, proxies }(rootPath, trustedProxies)
+	trustedProxies, _ = parseTrustedProxies([]string{"10.0.0.1"})
+
+	for _, tt := range []struct {
+		rootPath   string
+		remoteAddr string
+		scriptName string
+		url        string
+		root       string
+		path       string
+	}{
+		{"", "192.168.0.5:1234", "", "/app/foo/", "", "/app/foo/"},
+		{"/app", "192.168.0.5:1234", "", "/app/foo/", "/app", "/foo/"},
+		{"/app", "192.168.0.5:1234", "", "/app", "/app", "/"},
+		{"/app", "192.168.0.5:1234", "", "/appendix/", "/app", "/appendix/"},
+		{"/app", "192.168.0.5:1234", "/other", "/app/foo/", "/app", "/foo/"},
+		{"", "10.0.0.1:1234", "/shop/", "/shop/cart/", "/shop", "/cart/"},
+		{"/app", "10.0.0.1:1234", "/shop", "/cart/", "/shop", "/cart/"},
+	} {
+		rootPath = tt.rootPath
+		req := httptest.NewRequest("GET", tt.url, nil)
+		req.RemoteAddr = tt.remoteAddr
+		if tt.scriptName != "" {
+			req.Header.Set("X-Script-Name", tt.scriptName)
+		}
+
+		root, path := splitRootPath(req)
+		if root != tt.root || path != tt.path {
+			t.Errorf("Expected %s and %s for %s, got %s and %s", tt.root, tt.path, tt.url, root, path)
+		}
+	}
+}
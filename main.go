@@ -6,11 +6,15 @@ package main
 import (
 	"fmt"
 	"log"
+	"net/url"
 	"os"
+	"strings"
+	"time"
 
 	"github.com/urfave/cli"
 
 	"github.com/ostcar/geiss/asgi"
+	"github.com/ostcar/geiss/asgi/memory"
 	"github.com/ostcar/geiss/asgi/redis"
 )
 
@@ -50,10 +54,82 @@ func main() {
 			Value: nil,
 			Usage: "url and file path to serve static files in the form /static/:/path/to/files",
 		},
+		cli.DurationFlag{
+			Name:  "response-timeout",
+			Value: 30 * time.Second,
+			Usage: "time to wait for the response of a worker. Answers with 504, if there is no response in time",
+		},
+		cli.StringSliceFlag{
+			Name:  "response-timeout-path",
+			Usage: "response timeout for all paths with a prefix in the form PREFIX=DURATION, for example /export/=2m. Can be used multiple times. The rule with the longest prefix is used. The prefix does not contain the --root-path",
+		},
+		cli.DurationFlag{
+			Name:  "chunk-timeout",
+			Value: 30 * time.Second,
+			Usage: "time to wait for the next chunk of a streamed response",
+		},
+		cli.StringSliceFlag{
+			Name:  "chunk-timeout-path",
+			Usage: "chunk timeout for all paths with a prefix in the form PREFIX=DURATION",
+		},
+		cli.DurationFlag{
+			Name:  "handshake-timeout",
+			Value: 30 * time.Second,
+			Usage: "time to wait for a worker to accept a websocket connection. Answers with 504, if there is no answer in time",
+		},
+		cli.StringSliceFlag{
+			Name:  "handshake-timeout-path",
+			Usage: "handshake timeout for all paths with a prefix in the form PREFIX=DURATION",
+		},
+		cli.StringSliceFlag{
+			Name:  "tls-cert",
+			Usage: "certificate file to use https. Can be used multiple times. The certificate is selected by the server name of the client. The files are reloaded on SIGHUP or when they change",
+		},
+		cli.StringSliceFlag{
+			Name:  "tls-key",
+			Usage: "key file for the certificate. Has to be given once for each --tls-cert",
+		},
+		cli.StringFlag{
+			Name:  "root-path",
+			Usage: "url prefix, under which the application is mounted, for example /app. It is removed from the path and sent as root_path",
+		},
+		cli.StringFlag{
+			Name:  "trusted-proxies",
+			Usage: "comma separated list of networks in the form 10.0.0.0/8 or single ip addresses of proxies in front of Geiss. For requests from them, the client, scheme and server are taken from the Forwarded or X-Forwarded-* headers",
+		},
+		cli.DurationFlag{
+			Name:  "shutdown-timeout",
+			Value: 30 * time.Second,
+			Usage: "time to wait for open http responses and websocket connections on SIGTERM",
+		},
+		cli.StringFlag{
+			Name:  "layer",
+			Value: "redis",
+			Usage: "channel layer backend to use. Can be redis, redis-stream or memory",
+		},
+		cli.StringFlag{
+			Name:  "codec",
+			Value: "msgpack",
+			Usage: "format of the messages in the channel layer. Can be msgpack or json. Python workers need msgpack",
+		},
 		cli.StringFlag{
 			Name:  "redis, r",
 			Value: ":6379",
-			Usage: "host and port of the redis server in the form HOST:Port",
+			Usage: "redis server in the form HOST:Port or as redis://, rediss:// or unix:// url. Use a comma separated list to shard the channels across more then one redis server",
+		},
+		cli.StringFlag{
+			Name:  "redis-sentinel",
+			Usage: "comma separated list of redis sentinels in the form HOST:Port. If set, the address of the redis master is asked from the sentinels and the host of --redis is ignored",
+		},
+		cli.StringFlag{
+			Name:  "redis-sentinel-master",
+			Value: "mymaster",
+			Usage: "name of the redis master in the sentinels. Use a comma separated list to shard the channels across more then one master",
+		},
+		cli.StringFlag{
+			Name:   "redis-symmetric-encryption-keys",
+			EnvVar: "GEISS_SYMMETRIC_ENCRYPTION_KEYS",
+			Usage:  "comma separated list of keys to encrypt the messages in redis. The first key is used to encrypt, all keys are used to decrypt. Compatible with symmetric_encryption_keys of channels_redis",
 		},
 		cli.StringFlag{
 			Name:  "redis-prefix",
@@ -61,31 +137,202 @@ func main() {
 			Usage: "prefix of the redis keys",
 		},
 		cli.IntFlag{
-			Name:  "redis-capacity",
+			Name:  "redis-capacity, capacity",
 			Value: 100,
 			Usage: "channel capacity",
 		},
+		cli.StringSliceFlag{
+			Name:  "redis-channel-capacity",
+			Usage: "capacity for the channels that match a glob pattern in the form PATTERN=CAPACITY, for example websocket.send*=20. Can be used multiple times. The first matching rule is used",
+		},
 		cli.IntFlag{
-			Name:  "redis-expiry",
+			Name:  "redis-offload-threshold",
+			Usage: "messages bigger then this number of bytes are stored outside of the channel in the redis channel layer. 0 means no offloading",
+		},
+		cli.StringFlag{
+			Name:  "redis-offload-dir",
+			Usage: "directory to store offloaded messages. It has to be shared with all workers. If not set, they are stored in a separate redis key, which does not reduce the memory usage of redis",
+		},
+		cli.StringSliceFlag{
+			Name:  "redis-offload-channels",
+			Usage: "glob pattern of the channels, which messages can be offloaded. Can be used multiple times. Only go processes can read offloaded messages, so the channels must not be read by python workers. Defaults to the process specific channels *!*",
+		},
+		cli.IntFlag{
+			Name:  "redis-group-expiry",
+			Value: 86400,
+			Usage: "seconds until a channel is removed from a group in the redis channel layer",
+		},
+		cli.IntFlag{
+			Name:  "redis-expiry, expiry",
 			Value: 60,
 			Usage: "seconds until a message to the redis channel layer will expire",
 		},
 	}
 	app.Action = func(c *cli.Context) error {
-		channelLayer = redis.NewChannelLayer(
-			c.Int("redis-expiry"),
-			c.String("redis"),
-			c.String("redis-prefix"),
-			c.Int("redis-capacity"))
+		codec, err := asgi.GetCodec(c.String("codec"))
+		if err != nil {
+			return err
+		}
+
+		if err := setTimeout(&responseTimeout, c, "response-timeout"); err != nil {
+			return err
+		}
+		if err := setTimeout(&chunkTimeout, c, "chunk-timeout"); err != nil {
+			return err
+		}
+		if err := setTimeout(&handshakeTimeout, c, "handshake-timeout"); err != nil {
+			return err
+		}
+
+		hosts, err := redisHosts(c)
+		if err != nil {
+			return err
+		}
+
+		switch c.String("layer") {
+		case "redis":
+			layer, err := redis.NewChannelLayer(
+				c.Int("redis-expiry"),
+				hosts,
+				c.String("redis-prefix"),
+				c.Int("redis-capacity"),
+				c.Int("redis-group-expiry"))
+			if err != nil {
+				return err
+			}
+			layer.SetCodec(codec)
+			layer.SetSymmetricEncryptionKeys(encryptionKeys(c))
+			var rules []redis.CapacityRule
+			for _, value := range c.StringSlice("redis-channel-capacity") {
+				rule, err := redis.ParseCapacityRule(value)
+				if err != nil {
+					return err
+				}
+				rules = append(rules, rule)
+			}
+			if err := layer.SetChannelCapacity(rules); err != nil {
+				return err
+			}
+			if err := layer.SetOffloading(
+				c.Int("redis-offload-threshold"),
+				c.String("redis-offload-dir"),
+				c.StringSlice("redis-offload-channels")); err != nil {
+				return err
+			}
+			channelLayer = layer
+		case "redis-stream":
+			layer, err := redis.NewStreamChannelLayer(
+				c.Int("redis-expiry"),
+				hosts,
+				c.String("redis-prefix"),
+				c.Int("redis-capacity"))
+			if err != nil {
+				return err
+			}
+			layer.SetCodec(codec)
+			layer.SetSymmetricEncryptionKeys(encryptionKeys(c))
+			channelLayer = layer
+		case "memory":
+			layer := memory.NewChannelLayer(
+				c.Int("redis-expiry"),
+				c.Int("redis-capacity"))
+			layer.SetCodec(codec)
+			channelLayer = layer
+		default:
+			return fmt.Errorf("unknown channel layer \"%s\"", c.String("layer"))
+		}
+
+		if trustedProxies, err = parseTrustedProxies(strings.Split(c.String("trusted-proxies"), ",")); err != nil {
+			return err
+		}
+
+		rootPath = strings.TrimSuffix(c.String("root-path"), "/")
+		if rootPath != "" && !strings.HasPrefix(rootPath, "/") {
+			return fmt.Errorf("--root-path has to start with a slash")
+		}
+
+		var certs *certificates
+		if len(c.StringSlice("tls-cert")) > 0 || len(c.StringSlice("tls-key")) > 0 {
+			if certs, err = newCertificates(c.StringSlice("tls-cert"), c.StringSlice("tls-key")); err != nil {
+				return err
+			}
+		}
 
 		go globalReceive()
 
 		startHTTPServer(
 			fmt.Sprintf("%s:%d", c.String("host"), c.Int64("port")),
-			c.StringSlice("static"))
+			c.StringSlice("static"),
+			c.Duration("shutdown-timeout"),
+			certs)
 		return nil
 	}
 	if err := app.Run(os.Args); err != nil {
 		log.Fatalf("Received an error: %s", err)
 	}
 }
+
+// redisHosts returns the redis hosts from the command line options. If
+// sentinels are given, then it returns a sentinel url for each master. The
+// password, the database and the other options are taken from --redis, if it
+// is a redis:// or rediss:// url. With rediss://, the connections to the
+// masters use tls.
+func redisHosts(c *cli.Context) ([]string, error) {
+	if c.String("redis-sentinel") == "" {
+		return strings.Split(c.String("redis"), ","), nil
+	}
+
+	query := url.Values{}
+	var base *url.URL
+	if strings.Contains(c.String("redis"), "://") {
+		var err error
+		base, err = url.Parse(c.String("redis"))
+		if err != nil {
+			return nil, fmt.Errorf("invalid redis url %s: %s", c.String("redis"), err)
+		}
+		if base.Scheme != "redis" && base.Scheme != "rediss" {
+			return nil, fmt.Errorf("--redis-sentinel can only be used with a redis:// or rediss:// url in --redis")
+		}
+		query = base.Query()
+		if base.Scheme == "rediss" {
+			query.Set("tls", "true")
+		}
+	}
+	for _, sentinel := range strings.Split(c.String("redis-sentinel"), ",") {
+		query.Add("sentinel", sentinel)
+	}
+
+	var hosts []string
+	for _, master := range strings.Split(c.String("redis-sentinel-master"), ",") {
+		u := url.URL{Scheme: "sentinel", Host: master, RawQuery: query.Encode()}
+		if base != nil {
+			u.User = base.User
+			u.Path = base.Path
+		}
+		hosts = append(hosts, u.String())
+	}
+	return hosts, nil
+}
+
+// encryptionKeys returns the keys to encrypt the messages in redis.
+func encryptionKeys(c *cli.Context) []string {
+	if c.String("redis-symmetric-encryption-keys") == "" {
+		return nil
+	}
+	return strings.Split(c.String("redis-symmetric-encryption-keys"), ",")
+}
+
+// setTimeout sets a timeout from the command line option name and the rules
+// from the option name-path.
+func setTimeout(t *timeout, c *cli.Context, name string) error {
+	if c.Duration(name) <= 0 {
+		return fmt.Errorf("--%s has to be positive", name)
+	}
+	t.value = c.Duration(name)
+	for _, rule := range c.StringSlice(name + "-path") {
+		if err := t.addRule(rule); err != nil {
+			return err
+		}
+	}
+	return nil
+}
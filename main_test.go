@@ -0,0 +1,49 @@
+package main
+
+import (
+	"flag"
+	"reflect"
+	"testing"
+
+	"github.com/urfave/cli"
+)
+
+// redisContext returns a cli context with the redis options.
+func redisContext(redis, sentinel string) *cli.Context {
+	set := flag.NewFlagSet("test", flag.ContinueOnError)
+	set.String("redis", redis, "")
+	set.String("redis-sentinel", sentinel, "")
+	set.String("redis-sentinel-master", "m1,m2", "")
+	return cli.NewContext(nil, set, nil)
+}
+
+func TestRedisHosts(t *testing.T) {
+	for _, tt := range []struct {
+		redis    string
+		sentinel string
+		hosts    []string
+	}{
+		{":6379,:6380", "", []string{":6379", ":6380"}},
+		{":6379", "s1:26379", []string{"sentinel://m1?sentinel=s1%3A26379", "sentinel://m2?sentinel=s1%3A26379"}},
+		{"redis://:secret@localhost/2", "s1:26379", []string{
+			"sentinel://:secret@m1/2?sentinel=s1%3A26379",
+			"sentinel://:secret@m2/2?sentinel=s1%3A26379",
+		}},
+		{"rediss://:secret@localhost/2?ca_file=ca.pem", "s1:26379", []string{
+			"sentinel://:secret@m1/2?ca_file=ca.pem&sentinel=s1%3A26379&tls=true",
+			"sentinel://:secret@m2/2?ca_file=ca.pem&sentinel=s1%3A26379&tls=true",
+		}},
+	} {
+		hosts, err := redisHosts(redisContext(tt.redis, tt.sentinel))
+		if err != nil {
+			t.Errorf("Did not expect an error for %s, got %s", tt.redis, err)
+		}
+		if !reflect.DeepEqual(hosts, tt.hosts) {
+			t.Errorf("Expected %v for %s, got %v", tt.hosts, tt.redis, hosts)
+		}
+	}
+
+	if _, err := redisHosts(redisContext("unix:///var/run/redis.sock", "s1:26379")); err == nil {
+		t.Errorf("Expected an error for a unix socket with sentinels")
+	}
+}
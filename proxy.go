@@ -0,0 +1,210 @@
+package main
+
+import (
+	"fmt"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+)
+
+// trustedProxies are the networks of the proxies in front of Geiss. Only for
+// requests from these addresses, the Forwarded and X-Forwarded-* headers are
+// used.
+var trustedProxies []*net.IPNet
+
+// parseTrustedProxies parses a list of networks in the CIDR notation. Single
+// ip addresses are also allowed.
+func parseTrustedProxies(list []string) ([]*net.IPNet, error) {
+	var networks []*net.IPNet
+	for _, value := range list {
+		value = strings.TrimSpace(value)
+		if value == "" {
+			continue
+		}
+		if !strings.Contains(value, "/") {
+			ip := net.ParseIP(value)
+			if ip == nil {
+				return nil, fmt.Errorf("invalid trusted proxy %s", value)
+			}
+			bits := 8 * net.IPv6len
+			if ip.To4() != nil {
+				ip, bits = ip.To4(), 8*net.IPv4len
+			}
+			networks = append(networks, &net.IPNet{IP: ip, Mask: net.CIDRMask(bits, bits)})
+			continue
+		}
+		_, network, err := net.ParseCIDR(value)
+		if err != nil {
+			return nil, fmt.Errorf("invalid trusted proxy %s: %s", value, err)
+		}
+		networks = append(networks, network)
+	}
+	return networks, nil
+}
+
+// isTrustedProxy returns true, if the address is in one of the trusted
+// networks. The address can have a port.
+func isTrustedProxy(addr string) bool {
+	if host, _, err := net.SplitHostPort(addr); err == nil {
+		addr = host
+	}
+	ip := net.ParseIP(strings.Trim(addr, "[]"))
+	if ip == nil {
+		return false
+	}
+	for _, network := range trustedProxies {
+		if network.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// forwardedInfo are the values of the original request, that a proxy sent
+// with the request. Each value can be empty.
+type forwardedInfo struct {
+	client string // ip address of the client
+	proto  string // scheme of the original request
+	host   string // host of the original request, maybe with a port
+	port   string // port of the original request
+}
+
+// proxyInfo returns the values from the Forwarded header or, if it does not
+// exist, from the X-Forwarded-* headers. ok is false, if the request does not
+// come from a trusted proxy.
+func proxyInfo(req *http.Request) (info forwardedInfo, ok bool) {
+	if !isTrustedProxy(req.RemoteAddr) {
+		return info, false
+	}
+	if values := req.Header["Forwarded"]; len(values) > 0 {
+		return parseForwarded(strings.Join(values, ",")), true
+	}
+
+	info.client = clientFromList(headerList(req.Header, "X-Forwarded-For"))
+	info.proto = strings.ToLower(firstValue(req.Header, "X-Forwarded-Proto"))
+	info.host = firstValue(req.Header, "X-Forwarded-Host")
+	info.port = firstValue(req.Header, "X-Forwarded-Port")
+	return info, true
+}
+
+// parseForwarded parses the Forwarded header from RFC 7239. The values are
+// taken from the element that contains the client.
+func parseForwarded(header string) (info forwardedInfo) {
+	var elements []map[string]string
+	var clients []string
+	for _, element := range strings.Split(header, ",") {
+		pairs := make(map[string]string)
+		for _, pair := range strings.Split(element, ";") {
+			kv := strings.SplitN(pair, "=", 2)
+			if len(kv) != 2 {
+				continue
+			}
+			pairs[strings.ToLower(strings.TrimSpace(kv[0]))] = strings.Trim(strings.TrimSpace(kv[1]), "\"")
+		}
+		elements = append(elements, pairs)
+		clients = append(clients, forwardedIP(pairs["for"]))
+	}
+
+	i := clientIndex(clients)
+	if i < 0 {
+		return info
+	}
+	info.client = clients[i]
+	info.proto = strings.ToLower(elements[i]["proto"])
+	info.host = elements[i]["host"]
+	return info
+}
+
+// forwardedIP returns the ip address of a node in the Forwarded header. It
+// returns an empty string for unknown or obfuscated nodes.
+func forwardedIP(node string) string {
+	if host, _, err := net.SplitHostPort(node); err == nil {
+		node = host
+	}
+	node = strings.Trim(node, "[]")
+	if net.ParseIP(node) == nil {
+		return ""
+	}
+	return node
+}
+
+// clientFromList returns the client from a list of addresses like in the
+// X-Forwarded-For header.
+func clientFromList(addresses []string) string {
+	clients := make([]string, len(addresses))
+	for i, addr := range addresses {
+		clients[i] = forwardedIP(addr)
+	}
+	if i := clientIndex(clients); i >= 0 {
+		return clients[i]
+	}
+	return ""
+}
+
+// clientIndex returns the index of the client in a list of addresses, where
+// each proxy appended the address it got the request from. This is the last
+// address, that is not a trusted proxy. The addresses before it could be
+// faked by the client. Returns -1, if there is no valid address.
+func clientIndex(clients []string) int {
+	index := -1
+	for i := len(clients) - 1; i >= 0; i-- {
+		if clients[i] == "" {
+			break
+		}
+		index = i
+		if !isTrustedProxy(clients[i]) {
+			break
+		}
+	}
+	return index
+}
+
+// headerList returns all comma separated values of a header.
+func headerList(header http.Header, key string) (values []string) {
+	for _, line := range header[http.CanonicalHeaderKey(key)] {
+		for _, value := range strings.Split(line, ",") {
+			if value = strings.TrimSpace(value); value != "" {
+				values = append(values, value)
+			}
+		}
+	}
+	return values
+}
+
+// firstValue returns the first of the comma separated values of a header.
+func firstValue(header http.Header, key string) string {
+	if values := headerList(header, key); len(values) > 0 {
+		return values[0]
+	}
+	return ""
+}
+
+// validHost returns true, if host is an ip address or a host name. The values
+// from the proxy headers are not checked by the proxy, so they can contain
+// anything.
+func validHost(host string) bool {
+	if net.ParseIP(host) != nil {
+		return true
+	}
+	if host == "" || len(host) > 255 {
+		return false
+	}
+	for _, label := range strings.Split(strings.TrimSuffix(host, "."), ".") {
+		if label == "" || strings.HasPrefix(label, "-") || strings.HasSuffix(label, "-") {
+			return false
+		}
+		for _, r := range label {
+			if !(r >= 'a' && r <= 'z' || r >= 'A' && r <= 'Z' || r >= '0' && r <= '9' || r == '-' || r == '_') {
+				return false
+			}
+		}
+	}
+	return true
+}
+
+// validPort returns true, if port is a number between 0 and 65535.
+func validPort(port string) bool {
+	n, err := strconv.Atoi(port)
+	return err == nil && n >= 0 && n <= 65535
+}
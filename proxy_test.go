@@ -0,0 +1,140 @@
+package main
+
+import (
+	"net"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestParseTrustedProxies(t *testing.T) {
+	networks, err := parseTrustedProxies([]string{"10.0.0.0/8", " 192.168.0.1", "::1", ""})
+	if err != nil {
+		t.Fatalf("Did not expect an error, got %s", err)
+	}
+	if len(networks) != 3 {
+		t.Fatalf("Expected three networks, got %v", networks)
+	}
+
+	for _, value := range []string{"10.0.0.0/33", "localhost"} {
+		if _, err := parseTrustedProxies([]string{value}); err == nil {
+			t.Errorf("Expected an error for %s", value)
+		}
+	}
+}
+
+func TestProxyHeaders(t *testing.T) {
+	defer func(old []*net.IPNet) { trustedProxies = old }(trustedProxies)
+	trustedProxies, _ = parseTrustedProxies([]string{"10.0.0.0/8", "::1"})
+
+	for _, tt := range []struct {
+		name       string
+		remoteAddr string
+		headers    map[string]string
+		websocket  bool
+		client     string
+		scheme     string
+		server     string
+	}{
+		{
+			name:       "untrusted",
+			remoteAddr: "192.168.0.5:1234",
+			headers:    map[string]string{"X-Forwarded-For": "1.2.3.4", "X-Forwarded-Proto": "https"},
+			client:     "192.168.0.5:1234",
+			scheme:     "http",
+			server:     "example.com",
+		},
+		{
+			name:       "x-forwarded",
+			remoteAddr: "10.0.0.1:1234",
+			headers: map[string]string{
+				"X-Forwarded-For":   "1.2.3.4",
+				"X-Forwarded-Proto": "https",
+				"X-Forwarded-Host":  "www.example.org",
+			},
+			client: "1.2.3.4:0",
+			scheme: "https",
+			server: "www.example.org:443",
+		},
+		{
+			name:       "x-forwarded chain",
+			remoteAddr: "10.0.0.1:1234",
+			headers:    map[string]string{"X-Forwarded-For": "6.6.6.6, 1.2.3.4, 10.0.0.2", "X-Forwarded-Port": "8443"},
+			client:     "1.2.3.4:0",
+			scheme:     "http",
+			server:     "example.com",
+		},
+		{
+			name:       "x-forwarded websocket",
+			remoteAddr: "[::1]:1234",
+			headers:    map[string]string{"X-Forwarded-Proto": "https", "X-Forwarded-Host": "example.org", "X-Forwarded-Port": "8443"},
+			websocket:  true,
+			client:     "[::1]:1234",
+			scheme:     "wss",
+			server:     "example.org:8443",
+		},
+		{
+			name:       "forwarded",
+			remoteAddr: "10.0.0.1:1234",
+			headers:    map[string]string{"Forwarded": `for=6.6.6.6;proto=http, for="[2001:db8::1]:4711";proto=https;host="example.org:8000", for=10.0.0.2`},
+			client:     "[2001:db8::1]:0",
+			scheme:     "https",
+			server:     "example.org:8000",
+		},
+		{
+			name:       "forwarded obfuscated",
+			remoteAddr: "10.0.0.1:1234",
+			headers:    map[string]string{"Forwarded": `for=_hidden;proto=https`, "X-Forwarded-For": "1.2.3.4"},
+			client:     "10.0.0.1:1234",
+			scheme:     "http",
+			server:     "example.com",
+		},
+		{
+			name:       "invalid port",
+			remoteAddr: "10.0.0.1:1234",
+			headers:    map[string]string{"X-Forwarded-Host": "example.org", "X-Forwarded-Port": "abc"},
+			client:     "10.0.0.1:1234",
+			scheme:     "http",
+			server:     "example.com",
+		},
+		{
+			name:       "invalid port in host",
+			remoteAddr: "10.0.0.1:1234",
+			headers:    map[string]string{"Forwarded": `for=1.2.3.4;host="x:y"`},
+			client:     "1.2.3.4:0",
+			scheme:     "http",
+			server:     "example.com",
+		},
+		{
+			name:       "invalid host",
+			remoteAddr: "10.0.0.1:1234",
+			headers:    map[string]string{"X-Forwarded-Host": "exa mple/org:80"},
+			client:     "10.0.0.1:1234",
+			scheme:     "http",
+			server:     "example.com",
+		},
+		{
+			name:       "port out of range",
+			remoteAddr: "10.0.0.1:1234",
+			headers:    map[string]string{"X-Forwarded-Host": "example.org:99999"},
+			client:     "10.0.0.1:1234",
+			scheme:     "http",
+			server:     "example.com",
+		},
+	} {
+		req := httptest.NewRequest("GET", "http://example.com/", nil)
+		req.RemoteAddr = tt.remoteAddr
+		for k, v := range tt.headers {
+			req.Header.Set(k, v)
+		}
+
+		if got := clientAddress(req); got != tt.client {
+			t.Errorf("%s: Expected the client %s, got %s", tt.name, tt.client, got)
+		}
+		if got := requestScheme(req, tt.websocket); got != tt.scheme {
+			t.Errorf("%s: Expected the scheme %s, got %s", tt.name, tt.scheme, got)
+		}
+		if got := serverAddress(req); got != tt.server {
+			t.Errorf("%s: Expected the server %s, got %s", tt.name, tt.server, got)
+		}
+	}
+}
@@ -1,14 +1,28 @@
 package main
 
 import (
+	"context"
+	"crypto/tls"
 	"fmt"
 	"log"
 	"net/http"
+	"os"
+	"os/signal"
 	"strings"
+	"sync"
+	"syscall"
+	"time"
 
 	"github.com/gorilla/websocket"
 )
 
+// shuttingDown is closed, when the server shuts down. Open websocket
+// connections are closed in this case.
+var shuttingDown = make(chan struct{})
+
+// openWebsockets counts the websocket connections, that are not closed yet.
+var openWebsockets sync.WaitGroup
+
 // ASGIHandler handels all incomming requests
 func asgiHandler(w http.ResponseWriter, req *http.Request) {
 	var err error
@@ -38,12 +52,14 @@ func handleError(w http.ResponseWriter, m string, status int) {
 // Writes an output to the log for each incomming request.
 func httpLogger(handler http.Handler) http.Handler {
 	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
-		log.Printf("%s %s %s", r.RemoteAddr, r.Method, r.URL)
+		log.Printf("%s %s %s", clientAddress(r), r.Method, r.URL)
 		handler.ServeHTTP(w, r)
 	})
 }
 
-func startHTTPServer(listen string, statics []string) {
+// startHTTPServer starts the webserver and blocks until it was shut down with
+// SIGINT or SIGTERM. If certs is not nil, then the server uses https.
+func startHTTPServer(listen string, statics []string, shutdownTimeout time.Duration, certs *certificates) {
 	for _, static := range statics {
 		paths := strings.SplitN(static, ":", 2)
 		if len(paths) != 2 {
@@ -52,6 +68,53 @@ func startHTTPServer(listen string, statics []string) {
 		http.Handle(paths[0], http.StripPrefix(paths[0], http.FileServer(http.Dir(paths[1]))))
 	}
 	http.HandleFunc("/", asgiHandler)
-	log.Printf("Start webserver to listen on %s", listen)
-	log.Fatal(http.ListenAndServe(listen, httpLogger(http.DefaultServeMux)))
+	server := &http.Server{Addr: listen, Handler: httpLogger(http.DefaultServeMux)}
+
+	go func() {
+		var err error
+		if certs != nil {
+			server.TLSConfig = &tls.Config{GetCertificate: certs.getCertificate}
+			go certs.watch()
+			log.Printf("Start webserver to listen on %s with tls", listen)
+			err = server.ListenAndServeTLS("", "")
+		} else {
+			log.Printf("Start webserver to listen on %s", listen)
+			err = server.ListenAndServe()
+		}
+		if err != http.ErrServerClosed {
+			log.Fatal(err)
+		}
+	}()
+
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, syscall.SIGINT, syscall.SIGTERM)
+	log.Printf("Received %s, shut down the webserver", <-signals)
+	shutdown(server, shutdownTimeout)
+}
+
+// shutdown stops the server from accepting new connections, closes all
+// websocket connections with the code 1001 and waits until the open http
+// responses were sent. It waits at most for timeout.
+func shutdown(server *http.Server, timeout time.Duration) {
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+
+	// Close the websocket connections. They are hijacked, so server.Shutdown
+	// does not know about them.
+	close(shuttingDown)
+
+	if err := server.Shutdown(ctx); err != nil {
+		log.Printf("Error: Not all http responses were sent: %s", err)
+	}
+
+	websocketsClosed := make(chan struct{})
+	go func() {
+		openWebsockets.Wait()
+		close(websocketsClosed)
+	}()
+	select {
+	case <-websocketsClosed:
+	case <-ctx.Done():
+		log.Printf("Error: Not all websocket connections were closed")
+	}
 }
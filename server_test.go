@@ -0,0 +1,67 @@
+package main
+
+import (
+	"net"
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/ostcar/geiss/asgi"
+
+	"github.com/gorilla/websocket"
+)
+
+func TestShutdown(t *testing.T) {
+	defer func() { shuttingDown = make(chan struct{}) }()
+
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Did not expect an error, got %s", err)
+	}
+	server := &http.Server{Handler: http.HandlerFunc(asgiHandler)}
+	go server.Serve(listener)
+
+	// The worker accepts the connection.
+	go func() {
+		_, message, err := channelLayer.Receive([]string{"websocket.connect"}, true)
+		if err != nil {
+			t.Errorf("Did not expect an error, got %s", err)
+			return
+		}
+		var cm asgi.ConnectionMessage
+		cm.Set(message)
+		if cm.Scheme != "ws" || cm.Server != listener.Addr().String() || !strings.HasPrefix(cm.Client, "127.0.0.1:") {
+			t.Errorf("Got a wrong connect message: %+v", cm)
+		}
+		accept := asgi.SendCloseAcceptMessage{Accept: true}
+		channelLayer.Send(cm.ReplyChannel, accept.Raw())
+	}()
+
+	conn, _, err := websocket.DefaultDialer.Dial("ws://"+listener.Addr().String()+"/ws/", nil)
+	if err != nil {
+		t.Fatalf("Did not expect an error, got %s", err)
+	}
+	defer conn.Close()
+
+	shutdown(server, time.Second)
+
+	_, _, err = conn.ReadMessage()
+	if !websocket.IsCloseError(err, websocket.CloseGoingAway) {
+		t.Errorf("Expected the close code 1001, got %v", err)
+	}
+
+	channel, message, err := channelLayer.Receive([]string{"websocket.disconnect"}, false)
+	if err != nil || channel == "" {
+		t.Fatalf("Expected a message on websocket.disconnect, got %v", err)
+	}
+	var dm asgi.DisconnectionMessage
+	dm.Set(message)
+	if dm.Code != websocket.CloseGoingAway || dm.Path != "/ws/" {
+		t.Errorf("Got a wrong disconnect message: %+v", dm)
+	}
+
+	if _, err := net.Dial("tcp", listener.Addr().String()); err == nil {
+		t.Errorf("Expected the server to not accept new connections")
+	}
+}
@@ -99,3 +99,25 @@ func compareMessageHeader(header1, header2 [][2][]byte) bool {
 	}
 	return true
 }
+
+// abortedBody is a request body, that returns an error after size bytes, like
+// a client that closes the connection during an upload.
+type abortedBody struct {
+	size int
+}
+
+func (b *abortedBody) Read(p []byte) (int, error) {
+	if b.size == 0 {
+		return 0, fmt.Errorf("connection reset by peer")
+	}
+	n := len(p)
+	if n > b.size {
+		n = b.size
+	}
+	b.size -= n
+	return n, nil
+}
+
+func (b *abortedBody) Close() error {
+	return nil
+}
@@ -0,0 +1,58 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+	"time"
+)
+
+// timeoutRule sets the timeout for all requests with a path that starts with
+// prefix. The path does not contain the root path.
+type timeoutRule struct {
+	prefix  string
+	timeout time.Duration
+}
+
+// timeout is the time to wait for a message from the channel layer. It can be
+// different for some paths.
+type timeout struct {
+	value time.Duration
+	rules []timeoutRule
+}
+
+// Time to wait for the first response message of a http request.
+var responseTimeout = timeout{value: 30 * time.Second}
+
+// Time to wait for the next chunk of a http response.
+var chunkTimeout = timeout{value: 30 * time.Second}
+
+// Time to wait for the accept message of a websocket connection.
+var handshakeTimeout = timeout{value: 30 * time.Second}
+
+// forPath returns the timeout for a path. If more then one rule matches, the
+// rule with the longest prefix is used.
+func (t timeout) forPath(path string) time.Duration {
+	value := t.value
+	length := -1
+	for _, rule := range t.rules {
+		if strings.HasPrefix(path, rule.prefix) && len(rule.prefix) > length {
+			value = rule.timeout
+			length = len(rule.prefix)
+		}
+	}
+	return value
+}
+
+// addRule adds a rule in the form PREFIX=DURATION, for example /export/=2m.
+func (t *timeout) addRule(rule string) error {
+	i := strings.LastIndex(rule, "=")
+	if i <= 0 {
+		return fmt.Errorf("timeout rule %s has to be in the form PREFIX=DURATION", rule)
+	}
+	d, err := time.ParseDuration(rule[i+1:])
+	if err != nil || d <= 0 {
+		return fmt.Errorf("invalid duration in timeout rule %s", rule)
+	}
+	t.rules = append(t.rules, timeoutRule{prefix: rule[:i], timeout: d})
+	return nil
+}
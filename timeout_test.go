@@ -0,0 +1,39 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+func TestTimeoutForPath(t *testing.T) {
+	to := timeout{value: 30 * time.Second}
+	for _, rule := range []string{"/export/=2m", "/export/fast/=1s", "/a=b=5s"} {
+		if err := to.addRule(rule); err != nil {
+			t.Fatalf("Did not expect an error for %s, got %s", rule, err)
+		}
+	}
+
+	for _, tt := range []struct {
+		path    string
+		timeout time.Duration
+	}{
+		{"/", 30 * time.Second},
+		{"/export", 30 * time.Second},
+		{"/export/report.csv", 2 * time.Minute},
+		{"/export/fast/report.csv", time.Second},
+		{"/a=b", 5 * time.Second},
+	} {
+		if got := to.forPath(tt.path); got != tt.timeout {
+			t.Errorf("Expected %s for %s, got %s", tt.timeout, tt.path, got)
+		}
+	}
+}
+
+func TestAddTimeoutRuleInvalid(t *testing.T) {
+	var to timeout
+	for _, rule := range []string{"/export/", "=2m", "/export/=abc", "/export/=-1s"} {
+		if err := to.addRule(rule); err == nil {
+			t.Errorf("Expected an error for %s", rule)
+		}
+	}
+}
@@ -0,0 +1,130 @@
+package main
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"log"
+	"os"
+	"os/signal"
+	"sync"
+	"syscall"
+	"time"
+)
+
+// Time between two checks, if a certificate file was changed.
+const certReloadInterval = 10 * time.Second
+
+// certificates holds the tls certificates of the server. The certificate for a
+// connection is selected by the server name the client asks for (SNI).
+type certificates struct {
+	certFiles []string
+	keyFiles  []string
+
+	mu       sync.RWMutex
+	certs    []tls.Certificate
+	modified time.Time
+}
+
+// newCertificates loads the certificates from the files. The certificate
+// certFiles[i] uses the key keyFiles[i].
+func newCertificates(certFiles, keyFiles []string) (*certificates, error) {
+	if len(certFiles) == 0 {
+		return nil, fmt.Errorf("no tls certificate given")
+	}
+	if len(certFiles) != len(keyFiles) {
+		return nil, fmt.Errorf("got %d tls certificates but %d keys", len(certFiles), len(keyFiles))
+	}
+	c := &certificates{certFiles: certFiles, keyFiles: keyFiles}
+	if err := c.load(); err != nil {
+		return nil, err
+	}
+	return c, nil
+}
+
+// load reads all certificates from the files. If one of them can not be read,
+// then the old certificates are kept.
+func (c *certificates) load() error {
+	modified := c.lastModified()
+	certs := make([]tls.Certificate, len(c.certFiles))
+	for i := range c.certFiles {
+		cert, err := tls.LoadX509KeyPair(c.certFiles[i], c.keyFiles[i])
+		if err != nil {
+			return fmt.Errorf("can not load the tls certificate %s: %s", c.certFiles[i], err)
+		}
+		// Parse the certificate once, so it does not have to be parsed for each
+		// connection.
+		if cert.Leaf, err = x509.ParseCertificate(cert.Certificate[0]); err != nil {
+			return fmt.Errorf("can not parse the tls certificate %s: %s", c.certFiles[i], err)
+		}
+		certs[i] = cert
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.certs = certs
+	c.modified = modified
+	return nil
+}
+
+// lastModified returns the latest modification time of all certificate and key
+// files.
+func (c *certificates) lastModified() (modified time.Time) {
+	for _, files := range [][]string{c.certFiles, c.keyFiles} {
+		for _, file := range files {
+			info, err := os.Stat(file)
+			if err != nil {
+				continue
+			}
+			if info.ModTime().After(modified) {
+				modified = info.ModTime()
+			}
+		}
+	}
+	return modified
+}
+
+// changed returns true, if one of the files was changed since the last load.
+func (c *certificates) changed() bool {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	return c.lastModified().After(c.modified)
+}
+
+// getCertificate returns the first certificate that can be used for the
+// connection. If there is none, it returns the first certificate. It can be
+// used as tls.Config.GetCertificate.
+func (c *certificates) getCertificate(hello *tls.ClientHelloInfo) (*tls.Certificate, error) {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	for i := range c.certs {
+		if hello.SupportsCertificate(&c.certs[i]) == nil {
+			return &c.certs[i], nil
+		}
+	}
+	return &c.certs[0], nil
+}
+
+// watch reloads the certificates on SIGHUP or when one of the files was
+// changed. It never returns.
+func (c *certificates) watch() {
+	hangup := make(chan os.Signal, 1)
+	signal.Notify(hangup, syscall.SIGHUP)
+	ticker := time.NewTicker(certReloadInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-hangup:
+		case <-ticker.C:
+			if !c.changed() {
+				continue
+			}
+		}
+		if err := c.load(); err != nil {
+			log.Printf("Error: Can not reload the tls certificates: %s", err)
+			continue
+		}
+		log.Printf("Reloaded the tls certificates")
+	}
+}
@@ -0,0 +1,143 @@
+package main
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"io/ioutil"
+	"math/big"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// writeCertificate creates a self signed certificate for the host and writes
+// it with its key to dir. Returns the names of the files.
+func writeCertificate(t *testing.T, dir, host string) (certFile, keyFile string) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatalf("Did not expect an error, got %s", err)
+	}
+	template := x509.Certificate{
+		SerialNumber: big.NewInt(time.Now().UnixNano()),
+		Subject:      pkix.Name{CommonName: host},
+		DNSNames:     []string{host},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+	}
+	der, err := x509.CreateCertificate(rand.Reader, &template, &template, &key.PublicKey, key)
+	if err != nil {
+		t.Fatalf("Did not expect an error, got %s", err)
+	}
+	keyDer, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		t.Fatalf("Did not expect an error, got %s", err)
+	}
+
+	certFile = filepath.Join(dir, host+".crt")
+	keyFile = filepath.Join(dir, host+".key")
+	if err := ioutil.WriteFile(certFile, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}), 0600); err != nil {
+		t.Fatalf("Did not expect an error, got %s", err)
+	}
+	if err := ioutil.WriteFile(keyFile, pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDer}), 0600); err != nil {
+		t.Fatalf("Did not expect an error, got %s", err)
+	}
+	return certFile, keyFile
+}
+
+// serverName returns the name in the certificate, that is used for a
+// connection to host.
+func serverName(t *testing.T, c *certificates, host string) string {
+	cert, err := c.getCertificate(&tls.ClientHelloInfo{
+		ServerName:        host,
+		SupportedVersions: []uint16{tls.VersionTLS13},
+		SignatureSchemes:  []tls.SignatureScheme{tls.ECDSAWithP256AndSHA256},
+	})
+	if err != nil {
+		t.Fatalf("Did not expect an error, got %s", err)
+	}
+	return cert.Leaf.Subject.CommonName
+}
+
+func TestCertificatesSNI(t *testing.T) {
+	dir, err := ioutil.TempDir("", "geiss")
+	if err != nil {
+		t.Fatalf("Did not expect an error, got %s", err)
+	}
+	defer os.RemoveAll(dir)
+
+	cert1, key1 := writeCertificate(t, dir, "one.example.com")
+	cert2, key2 := writeCertificate(t, dir, "two.example.com")
+	c, err := newCertificates([]string{cert1, cert2}, []string{key1, key2})
+	if err != nil {
+		t.Fatalf("Did not expect an error, got %s", err)
+	}
+
+	for host, expected := range map[string]string{
+		"one.example.com":   "one.example.com",
+		"two.example.com":   "two.example.com",
+		"three.example.com": "one.example.com",
+	} {
+		if got := serverName(t, c, host); got != expected {
+			t.Errorf("Expected the certificate %s for %s, got %s", expected, host, got)
+		}
+	}
+}
+
+func TestCertificatesReload(t *testing.T) {
+	dir, err := ioutil.TempDir("", "geiss")
+	if err != nil {
+		t.Fatalf("Did not expect an error, got %s", err)
+	}
+	defer os.RemoveAll(dir)
+
+	certFile, keyFile := writeCertificate(t, dir, "example.com")
+	c, err := newCertificates([]string{certFile}, []string{keyFile})
+	if err != nil {
+		t.Fatalf("Did not expect an error, got %s", err)
+	}
+	old := c.certs[0].Leaf.SerialNumber
+	if c.changed() {
+		t.Errorf("Did not expect the certificates to be changed")
+	}
+
+	// Write a new certificate with a new modification time.
+	writeCertificate(t, dir, "example.com")
+	future := time.Now().Add(time.Minute)
+	os.Chtimes(certFile, future, future)
+	if !c.changed() {
+		t.Errorf("Expected the certificates to be changed")
+	}
+	if err := c.load(); err != nil {
+		t.Fatalf("Did not expect an error, got %s", err)
+	}
+	if c.certs[0].Leaf.SerialNumber.Cmp(old) == 0 {
+		t.Errorf("Expected the new certificate to be loaded")
+	}
+
+	// A broken file does not replace the loaded certificate.
+	ioutil.WriteFile(keyFile, []byte("broken"), 0600)
+	if err := c.load(); err == nil {
+		t.Errorf("Expected an error for a broken key")
+	}
+	if len(c.certs) != 1 || c.certs[0].Leaf == nil {
+		t.Errorf("Expected the old certificate to be kept")
+	}
+}
+
+func TestNewCertificatesInvalid(t *testing.T) {
+	if _, err := newCertificates(nil, nil); err == nil {
+		t.Errorf("Expected an error without certificates")
+	}
+	if _, err := newCertificates([]string{"a.crt", "b.crt"}, []string{"a.key"}); err == nil {
+		t.Errorf("Expected an error for a missing key")
+	}
+	if _, err := newCertificates([]string{"/does/not/exist.crt"}, []string{"/does/not/exist.key"}); err == nil {
+		t.Errorf("Expected an error for a missing file")
+	}
+}
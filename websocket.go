@@ -4,6 +4,7 @@ import (
 	"fmt"
 	"log"
 	"net/http"
+	"time"
 
 	"github.com/ostcar/geiss/asgi"
 
@@ -54,12 +55,9 @@ func websocketLoop(conn *websocket.Conn, channel string, readChan chan asgi.Mess
 	order := 0
 	// Code that is sent to the channel layer. 1006 is used, when no close message was received
 	closeCode := 1006
-	closed := false
 
 	// In the end: Close the websocket connection and inform the channel layer about it.
 	defer func() {
-		close(readChan)
-		closed = true
 		order++
 		dm := asgi.DisconnectionMessage{
 			ReplyChannel: channel,
@@ -114,6 +112,13 @@ func websocketLoop(conn *websocket.Conn, channel string, readChan chan asgi.Mess
 				return
 			}
 
+		// The server shuts down. Tell the client and the worker, that the
+		// server goes away.
+		case <-shuttingDown:
+			closeCode = websocket.CloseGoingAway
+			writeClose(conn, closeCode, "server shutdown")
+			return
+
 		// Received a message from the channel layer
 		case message := <-readChan:
 			var am asgi.SendCloseAcceptMessage
@@ -128,18 +133,36 @@ func websocketLoop(conn *websocket.Conn, channel string, readChan chan asgi.Mess
 			} else if am.Bytes != nil {
 				t = websocket.BinaryMessage
 				content = am.Bytes
-			} else {
-				// Got an message without data. Skip it.
-				continue
 			}
-			if err := conn.WriteMessage(t, content); err != nil {
-				log.Printf("Could not send message to a websocket clint: %s", err)
+			if t != 0 {
+				if err := conn.WriteMessage(t, content); err != nil {
+					log.Printf("Could not send message to a websocket clint: %s", err)
+					return
+				}
+			}
+
+			// The worker wants to close the connection. This can happen after
+			// sending the data of the same message.
+			if am.Close != 0 {
+				closeCode = am.Close
+				writeClose(conn, closeCode, "")
 				return
 			}
 		}
 	}
 }
 
+// writeClose sends a close message with the code to the websocket client.
+func writeClose(conn *websocket.Conn, code int, text string) {
+	err := conn.WriteControl(
+		websocket.CloseMessage,
+		websocket.FormatCloseMessage(code, text),
+		time.Now().Add(time.Second))
+	if err != nil {
+		log.Printf("Could not send the close message to a websocket client: %s", err)
+	}
+}
+
 // Create the reply channel name for a websocket.send channel.
 func createWebsocketReplyChannel() (replyChannel string, err error) {
 	replyChannel, err = channelLayer.NewChannel(globalChannelname)
@@ -152,14 +175,16 @@ func createWebsocketReplyChannel() (replyChannel string, err error) {
 // Sends the websocket handshake to the channel layer..
 func forwardWebsocketConnection(req *http.Request, channel string) (err error) {
 	// Send a connection message to the channel layer.
+	root, path := splitRootPath(req)
 	cm := asgi.ConnectionMessage{
 		ReplyChannel: channel,
-		Scheme:       req.URL.Scheme,
-		Path:         req.URL.Path,
+		Scheme:       requestScheme(req, true),
+		Path:         path,
+		RootPath:     root,
 		QueryString:  []byte(req.URL.RawQuery),
 		Headers:      req.Header,
-		Client:       req.Host, //TODO use the right value
-		Server:       req.Host,
+		Client:       clientAddress(req),
+		Server:       serverAddress(req),
 	}
 	err = channelLayer.Send("websocket.connect", cm.Raw())
 	if err != nil {
@@ -171,16 +196,22 @@ func forwardWebsocketConnection(req *http.Request, channel string) (err error) {
 // Handles the response after a websocket connection. Returns the websocket connection
 // if it was opend.
 // The third return value is a channel that has to be closed when the websocket
-// connection is closed in any way. This happens never in this function so make
-// sure to close it, even when this function returns an error.
+// connection is closed in any way. It is never nil and it is never closed in
+// this function, so make sure to close it, even when this function returns an
+// error.
 func receiveAccept(w http.ResponseWriter, req *http.Request, channel string) (*websocket.Conn, chan asgi.Message, chan<- bool, error) {
 	// Get a message from the channel layer.
 	var am asgi.SendCloseAcceptMessage
 	c, done := readFromChannel(channel)
 
-	// Read from the channel. Try to get a response for httpResponseWait seconds.
-	// If there is no response in this time, then break.
-	message, err := readTimeout(c, httpResponseWait)
+	// Read from the channel. Try to get a response for the handshake timeout.
+	// If there is no response in this time, then break. The timeout rules use
+	// the path without the root path.
+	_, path := splitRootPath(req)
+	message, err := readTimeout(c, handshakeTimeout.forPath(path), req.Context().Done())
+	if err == errTimeout {
+		w.WriteHeader(http.StatusGatewayTimeout)
+	}
 	if err != nil {
 		// Did not receive a message. Close the done-channel and
 		return nil, nil, done, fmt.Errorf("could not read from channel %s: %s", channel, err)
@@ -212,7 +243,6 @@ func receiveAccept(w http.ResponseWriter, req *http.Request, channel string) (*w
 		if am.Close != 0 {
 			// The connection was opened but should be closed again
 			if err = conn.CloseHandler()(am.Close, ""); err != nil {
-				close(done)
 				return nil, nil, done, asgi.NewForwardError("Could not close the websocket connection", err)
 			}
 			// An close message was send to the client but we return the connection
@@ -225,16 +255,20 @@ func receiveAccept(w http.ResponseWriter, req *http.Request, channel string) (*w
 	// If we are here, then the websocket connection should not be opened
 	if am.Close == 0 {
 		// At this point, close has to be set.
-		return nil, nil, nil, fmt.Errorf("Got an send/close/accept message with all fields set to nil")
+		return nil, nil, done, fmt.Errorf("Got an send/close/accept message with all fields set to nil")
 	}
 	w.WriteHeader(403)
-	close(done)
 	return nil, nil, done, nil
 }
 
 // Handels an request that wants to be upgraded to a websocket connection.
 // Returns an error if one happen.
 func asgiWebsocketHandler(w http.ResponseWriter, req *http.Request) (err error) {
+	// The connection is hijacked after the handshake, so the server does not
+	// wait for it on shutdown.
+	openWebsockets.Add(1)
+	defer openWebsockets.Done()
+
 	// Create a reply channel name.
 	channelname, err := createWebsocketReplyChannel()
 	if err != nil {
@@ -264,6 +298,7 @@ func asgiWebsocketHandler(w http.ResponseWriter, req *http.Request) (err error)
 	}
 
 	// The websocket connection was opened. Handle all messages in a loop
-	websocketLoop(conn, channelname, readChan, req.URL.Path)
+	_, path := splitRootPath(req)
+	websocketLoop(conn, channelname, readChan, path)
 	return nil
 }
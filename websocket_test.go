@@ -0,0 +1,181 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/ostcar/geiss/asgi"
+	"github.com/ostcar/geiss/asgi/worker"
+
+	"github.com/gorilla/websocket"
+)
+
+// closingHandler is a worker.WebsocketHandler, that rejects connections to
+// /reject/ and closes all other connections after the first message.
+type closingHandler struct {
+	disconnected chan int
+}
+
+func (h closingHandler) Connect(conn *worker.WebsocketConn, m *asgi.ConnectionMessage) error {
+	if m.Path == "/reject/" {
+		return conn.Reject()
+	}
+	return conn.Accept()
+}
+
+func (h closingHandler) Receive(conn *worker.WebsocketConn, m *asgi.ReceiveMessage) error {
+	return conn.Close(4000)
+}
+
+func (h closingHandler) Disconnect(m *asgi.DisconnectionMessage) error {
+	h.disconnected <- m.Code
+	return nil
+}
+
+// newWebsocketServer starts a server with asgiWebsocketHandler. It returns the
+// websocket url of the server.
+func newWebsocketServer(t *testing.T) (*httptest.Server, string) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		defer func() {
+			if r := recover(); r != nil {
+				t.Errorf("The handler panicked: %v", r)
+			}
+		}()
+		if err := asgiWebsocketHandler(w, req); err != nil {
+			t.Errorf("Did not expect an error, got %s", err)
+		}
+	}))
+	return server, "ws" + strings.TrimPrefix(server.URL, "http")
+}
+
+// startWebsocketServer starts a server with asgiWebsocketHandler and a worker
+// with the handler. The returned function stops both.
+func startWebsocketServer(t *testing.T, handler worker.WebsocketHandler) (url string, stop func()) {
+	server, url := newWebsocketServer(t)
+
+	done := make(chan struct{})
+	stopped := make(chan struct{})
+	go func() {
+		defer close(stopped)
+		w := &worker.Worker{Layer: channelLayer, Websocket: handler, Concurrency: 1}
+		w.Run(done)
+	}()
+
+	return url, func() {
+		server.Close()
+		close(done)
+		<-stopped
+	}
+}
+
+func TestWebsocketWorkerReject(t *testing.T) {
+	url, stop := startWebsocketServer(t, closingHandler{disconnected: make(chan int, 1)})
+	defer stop()
+
+	_, response, err := websocket.DefaultDialer.Dial(url+"/reject/", nil)
+	if err != websocket.ErrBadHandshake {
+		t.Fatalf("Expected the handshake to fail, got %v", err)
+	}
+	if response.StatusCode != http.StatusForbidden {
+		t.Errorf("Expected the status 403, got %d", response.StatusCode)
+	}
+}
+
+func TestWebsocketWorkerClose(t *testing.T) {
+	handler := closingHandler{disconnected: make(chan int, 1)}
+	url, stop := startWebsocketServer(t, handler)
+	defer stop()
+
+	conn, _, err := websocket.DefaultDialer.Dial(url+"/ws/", nil)
+	if err != nil {
+		t.Fatalf("Did not expect an error, got %s", err)
+	}
+	defer conn.Close()
+
+	if err := conn.WriteMessage(websocket.TextMessage, []byte("bye")); err != nil {
+		t.Fatalf("Did not expect an error, got %s", err)
+	}
+	conn.SetReadDeadline(time.Now().Add(time.Second))
+	if _, _, err := conn.ReadMessage(); !websocket.IsCloseError(err, 4000) {
+		t.Errorf("Expected the close code 4000, got %v", err)
+	}
+
+	select {
+	case code := <-handler.disconnected:
+		if code != 4000 {
+			t.Errorf("Expected the close code 4000 in the disconnect message, got %d", code)
+		}
+	case <-time.After(time.Second):
+		t.Errorf("Expected a disconnect message")
+	}
+}
+
+// answerConnect receives a message from the channel and sends the answer like
+// a django worker, that does not set all fields of the message.
+func answerConnect(t *testing.T, channel string, answer asgi.Message) {
+	_, message, err := channelLayer.Receive([]string{channel}, true)
+	if err != nil {
+		t.Errorf("Did not expect an error, got %s", err)
+		return
+	}
+	if err := channelLayer.Send(message["reply_channel"].(string), answer); err != nil {
+		t.Errorf("Did not expect an error, got %s", err)
+	}
+}
+
+func TestWebsocketRejectMessage(t *testing.T) {
+	server, url := newWebsocketServer(t)
+	defer server.Close()
+
+	// close: true rejects the connection.
+	go answerConnect(t, "websocket.connect", asgi.Message{"close": true})
+
+	_, response, err := websocket.DefaultDialer.Dial(url+"/ws/", nil)
+	if err != websocket.ErrBadHandshake {
+		t.Fatalf("Expected the handshake to fail, got %v", err)
+	}
+	if response.StatusCode != http.StatusForbidden {
+		t.Errorf("Expected the status 403, got %d", response.StatusCode)
+	}
+}
+
+func TestWebsocketCloseMessage(t *testing.T) {
+	server, url := newWebsocketServer(t)
+	defer server.Close()
+
+	// close: false does not close the connection.
+	go answerConnect(t, "websocket.connect", asgi.Message{"accept": true, "close": false})
+
+	conn, _, err := websocket.DefaultDialer.Dial(url+"/ws/", nil)
+	if err != nil {
+		t.Fatalf("Did not expect an error, got %s", err)
+	}
+	defer conn.Close()
+
+	// close: true closes the connection with the normal close code.
+	go answerConnect(t, "websocket.receive", asgi.Message{"text": "bye", "close": true})
+	if err := conn.WriteMessage(websocket.TextMessage, []byte("hello")); err != nil {
+		t.Fatalf("Did not expect an error, got %s", err)
+	}
+
+	conn.SetReadDeadline(time.Now().Add(time.Second))
+	if _, content, err := conn.ReadMessage(); err != nil || string(content) != "bye" {
+		t.Errorf("Expected the message \"bye\", got \"%s\" and %v", content, err)
+	}
+	if _, _, err := conn.ReadMessage(); !websocket.IsCloseError(err, websocket.CloseNormalClosure) {
+		t.Errorf("Expected the close code 1000, got %v", err)
+	}
+
+	channel, message, err := channelLayer.Receive([]string{"websocket.disconnect"}, true)
+	if err != nil || channel == "" {
+		t.Fatalf("Expected a message on websocket.disconnect, got %v", err)
+	}
+	var dm asgi.DisconnectionMessage
+	dm.Set(message)
+	if dm.Code != websocket.CloseNormalClosure {
+		t.Errorf("Expected the close code 1000 in the disconnect message, got %d", dm.Code)
+	}
+}